@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions bar staff can take on a product's price or the menu. Each is
+// recorded in the event log, which doubles as the audit log of what staff did.
+const AdminCrash = "crash"
+const AdminFreeze = "freeze"
+const AdminUnfreeze = "unfreeze"
+const AdminSetPrice = "price"
+const AdminCreate = "create"
+const AdminUpdate = "update"
+const AdminRetire = "retire"
+
+type adminProductRequest struct {
+	ID        int      `json:"id,omitempty"`
+	Name      *string  `json:"name,omitempty"`
+	BasePrice *int     `json:"basePrice,omitempty"`
+	CostPrice *int     `json:"costPrice,omitempty"`
+	ABV       *float64 `json:"abv,omitempty"`
+	Volume    *int     `json:"volumeMl,omitempty"`
+}
+
+type adminProductResponse struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	BasePrice    int    `json:"basePrice"`
+	CostPrice    int    `json:"costPrice,omitempty"`
+	Current      string `json:"current"`
+	CurrentMinor int    `json:"currentMinor"`
+	Frozen       bool   `json:"frozen"`
+}
+
+type adminPriceRequest struct {
+	CurrentPrice *int `json:"currentPrice"`
+}
+
+func registerAdminRoutes(r *mux.Router, token string) {
+	admin := r.PathPrefix("/admin").Subrouter()
+
+	admin.HandleFunc("/products", requireAdmin(token, withMarket(createProduct))).Methods(http.MethodPost)
+	admin.HandleFunc("/products/{id:[0-9]+}", requireAdmin(token, withMarket(updateProduct))).Methods(http.MethodPut)
+	admin.HandleFunc("/products/{id:[0-9]+}", requireAdmin(token, withMarket(retireProduct))).Methods(http.MethodDelete)
+
+	admin.HandleFunc("/products/{id:[0-9]+}/crash", requireAdmin(token, withMarket(crashProduct))).Methods(http.MethodPost)
+	admin.HandleFunc("/products/{id:[0-9]+}/freeze", requireAdmin(token, withMarket(freezeProduct))).Methods(http.MethodPost)
+	admin.HandleFunc("/products/{id:[0-9]+}/unfreeze", requireAdmin(token, withMarket(unfreezeProduct))).Methods(http.MethodPost)
+	admin.HandleFunc("/products/{id:[0-9]+}/price", requireAdmin(token, withMarket(setProductPrice))).Methods(http.MethodPut)
+
+	admin.HandleFunc("/market/pause", requireAdmin(token, withMarket(pauseMarket))).Methods(http.MethodPost)
+	admin.HandleFunc("/market/resume", requireAdmin(token, withMarket(resumeMarket))).Methods(http.MethodPost)
+}
+
+// requireAdmin only lets through requests carrying the admin token as a
+// bearer token.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func createProduct(w http.ResponseWriter, r *http.Request, market *Market) {
+	menu := market.Menu
+
+	var request adminProductRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if request.ID == 0 {
+		request.ID = menu.NextID()
+	}
+	product := request.product()
+
+	err = market.Config.validateProduct(product, map[int]bool{})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var created *Product
+	_, err = menu.Lookup(product.ID)
+	if err == nil {
+		err = fmt.Errorf("product %d already exists", product.ID)
+	} else {
+		menu.Log.Record(menuEntry(market, product.ID, AdminCreate, &request), func() {
+			created, err = market.createProduct(product)
+		})
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeAdminProduct(w, http.StatusCreated, created)
+}
+
+// product is the configuration of the product the request describes.
+func (request adminProductRequest) product() ProductConfig {
+	product := ProductConfig{ID: request.ID}
+	if request.Name != nil {
+		product.Name = *request.Name
+	}
+	if request.BasePrice != nil {
+		product.BasePrice = *request.BasePrice
+	}
+	if request.CostPrice != nil {
+		product.CostPrice = *request.CostPrice
+	}
+	if request.ABV != nil {
+		product.ABV = *request.ABV
+	}
+	if request.Volume != nil {
+		product.Volume = *request.Volume
+	}
+	return product
+}
+
+func (market *Market) createProduct(product ProductConfig) (*Product, error) {
+	menu := market.Menu
+	return menu.Create(product.ID, func() *Product {
+		return market.Config.NewProduct(product, menu.ProductOptions()...)
+	})
+}
+
+func updateProduct(w http.ResponseWriter, r *http.Request, market *Market) {
+	product, ok := adminProduct(w, r, market)
+	if !ok {
+		return
+	}
+
+	var request adminProductRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if request.Name != nil && strings.TrimSpace(*request.Name) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("name is required"))
+		return
+	}
+	if request.BasePrice != nil && *request.BasePrice <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("basePrice must be a positive number of pence"))
+		return
+	}
+
+	if request.BasePrice != nil {
+		err = product.CheckBasePrice(*request.BasePrice)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	// Only the name and base price can be changed.
+	update := adminProductRequest{Name: request.Name, BasePrice: request.BasePrice}
+	market.Menu.Log.Record(menuEntry(market, product.ID, AdminUpdate, &update), func() {
+		err = product.Update(update)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeAdminProduct(w, http.StatusOK, product)
+}
+
+// Update renames and reprices the product, where the request says to.
+func (product *Product) Update(request adminProductRequest) error {
+	if request.BasePrice != nil {
+		err := product.SetBasePrice(*request.BasePrice)
+		if err != nil {
+			return err
+		}
+	}
+	if request.Name != nil {
+		product.Rename(*request.Name)
+	}
+	return nil
+}
+
+func retireProduct(w http.ResponseWriter, r *http.Request, market *Market) {
+	product, ok := adminProduct(w, r, market)
+	if !ok {
+		return
+	}
+
+	var err error
+	market.Menu.Log.Record(menuEntry(market, product.ID, AdminRetire, nil), func() {
+		_, err = market.Menu.Retire(product.ID)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminProduct(w http.ResponseWriter, r *http.Request, market *Market) (*Product, bool) {
+	productID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	product, err := market.Menu.Product(productID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return nil, false
+	}
+
+	return product, true
+}
+
+func writeAdminProduct(w http.ResponseWriter, status int, product *Product) {
+	product.lock.RLock()
+	response := adminProductResponse{
+		ID:           product.ID,
+		Name:         product.Name,
+		BasePrice:    product.BasePrice,
+		CostPrice:    product.CostPrice,
+		Current:      product.money.Format(product.Current()),
+		CurrentMinor: product.Current(),
+		Frozen:       product.frozen,
+	}
+	product.lock.RUnlock()
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// pauseMarket holds the market's prices where they are, so they don't tick
+// down while the bar is shut.
+func pauseMarket(w http.ResponseWriter, r *http.Request, market *Market) {
+	market.Menu.Scheduler.Pause()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func resumeMarket(w http.ResponseWriter, r *http.Request, market *Market) {
+	market.Menu.Scheduler.Resume()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Apply carries out a staff action on the product. Crashing a product whose
+// price is held does nothing.
+func (product *Product) Apply(action string, price int) error {
+	switch action {
+	case AdminCrash:
+		product.ForceCrash(CrashManual, "")
+	case AdminFreeze:
+		product.Freeze()
+	case AdminUnfreeze:
+		product.Unfreeze()
+	case AdminSetPrice:
+		return product.SetPrice(price)
+	default:
+		return fmt.Errorf("unknown admin action %q", action)
+	}
+	return nil
+}
+
+// ApplyAdmin carries out a logged staff action on the market and returns the
+// product it acted on. Actions on a product that isn't on the menu, and
+// products created with an ID that is taken, are skipped.
+func (market *Market) ApplyAdmin(entry LogEntry) (*Product, error) {
+	menu := market.Menu
+
+	switch entry.Action {
+	case AdminCreate:
+		if entry.Product == nil {
+			return nil, fmt.Errorf("create entry has no product")
+		}
+		request := *entry.Product
+		request.ID = entry.ProductID
+		created, err := market.createProduct(request.product())
+		if err != nil {
+			return nil, nil
+		}
+		return created, nil
+	case AdminRetire:
+		retired, err := menu.Retire(entry.ProductID)
+		if err != nil {
+			return nil, nil
+		}
+		return retired, nil
+	}
+
+	product, err := menu.Product(entry.ProductID)
+	if err != nil {
+		return nil, nil
+	}
+
+	if entry.Action == AdminUpdate {
+		if entry.Product == nil {
+			return nil, fmt.Errorf("update entry has no product")
+		}
+		return product, product.Update(*entry.Product)
+	}
+	return product, product.Apply(entry.Action, entry.Price)
+}
+
+func adminEntry(market *Market, product *Product, action string, price int) LogEntry {
+	return LogEntry{
+		Type:       LogAdmin,
+		LocationID: market.LocationID,
+		ProductID:  product.ID,
+		Action:     action,
+		Price:      price,
+	}
+}
+
+// menuEntry logs a product being added to, changed on or retired from the
+// menu, with what the request set.
+func menuEntry(market *Market, productID int, action string, request *adminProductRequest) LogEntry {
+	return LogEntry{
+		Type:       LogAdmin,
+		LocationID: market.LocationID,
+		ProductID:  productID,
+		Action:     action,
+		Product:    request,
+	}
+}
+
+// crashProduct fires a crash on a product there and then, whatever its price.
+func crashProduct(w http.ResponseWriter, r *http.Request, market *Market) {
+	product, ok := adminProduct(w, r, market)
+	if !ok {
+		return
+	}
+
+	var crash Crash
+	err := product.CheckCrash()
+	if err == nil {
+		market.Menu.Log.Record(adminEntry(market, product, AdminCrash, 0), func() {
+			crash, err = product.ForceCrash(CrashManual, "")
+		})
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newCrashResp(crash, market.Menu.Money))
+}
+
+func freezeProduct(w http.ResponseWriter, r *http.Request, market *Market) {
+	applyAdmin(w, r, market, AdminFreeze)
+}
+
+func unfreezeProduct(w http.ResponseWriter, r *http.Request, market *Market) {
+	applyAdmin(w, r, market, AdminUnfreeze)
+}
+
+func applyAdmin(w http.ResponseWriter, r *http.Request, market *Market, action string) {
+	product, ok := adminProduct(w, r, market)
+	if !ok {
+		return
+	}
+
+	market.Menu.Log.Record(adminEntry(market, product, action, 0), func() {
+		product.Apply(action, 0)
+	})
+
+	writeAdminProduct(w, http.StatusOK, product)
+}
+
+func setProductPrice(w http.ResponseWriter, r *http.Request, market *Market) {
+	product, ok := adminProduct(w, r, market)
+	if !ok {
+		return
+	}
+
+	var request adminPriceRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if request.CurrentPrice == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("currentPrice is required"))
+		return
+	}
+
+	price := *request.CurrentPrice
+	err = product.CheckPrice(price)
+	if err == nil {
+		market.Menu.Log.Record(adminEntry(market, product, AdminSetPrice, price), func() {
+			err = product.SetPrice(price)
+		})
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeAdminProduct(w, http.StatusOK, product)
+}
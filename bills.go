@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBillQuantity is more items than any real bill has, on one line or in
+// total. Bills over it are refused rather than moving prices that far.
+const maxBillQuantity = 1000
+
+// billRetention is how long a bill is remembered after it was last posted.
+// POS systems retry and update bills within an evening, not across days.
+const billRetention = 24 * time.Hour
+
+type billKey struct {
+	LocationID int
+	BillID     int
+}
+
+type billRecord struct {
+	lines       map[string]int
+	productIDs  map[string]int
+	voids       map[string]bool
+	lastUpdated string
+	seen        time.Time
+}
+
+// BillSale is a change in the number of sales of one product. A negative
+// count means sales were voided or refunded. Lines holds the bill lines newly
+// counted for a positive change.
+type BillSale struct {
+	ProductID int
+	Count     int
+	Lines     []billEventProduct
+}
+
+// PriceMismatch is a bill line charged at a different price to the one the
+// market was showing when the bill was updated.
+type PriceMismatch struct {
+	BillID     int
+	LocationID int
+	ProductID  int
+	Time       time.Time
+	Charged    int
+	Shown      int
+}
+
+// maxMismatches bounds how many price mismatches are kept for review.
+const maxMismatches = 1000
+
+// BillLedger remembers which lines of each bill have already moved prices, so
+// a bill that is retried or re-sent only counts what has changed.
+type BillLedger struct {
+	lock       sync.Mutex
+	bills      map[billKey]*billRecord
+	expired    time.Time
+	mismatches []PriceMismatch
+}
+
+func NewBillLedger() *BillLedger {
+	return &BillLedger{bills: map[billKey]*billRecord{}}
+}
+
+// Record returns how the bill's sales have changed since it was last posted:
+// new lines count as sales, or against them for lines with a negative
+// quantity, and lines that have gone undo what they counted. Bills without an
+// id can't be told apart, so every line on them counts. A re-sent
+// bill with an older lastUpdated than one already seen is ignored.
+func (ledger *BillLedger) Record(bill billEventBill, now time.Time) []BillSale {
+	if bill.ID == 0 {
+		return lineSales(bill, 1)
+	}
+
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	record, fresh := ledger.record(bill, now)
+	if !fresh {
+		return nil
+	}
+
+	counts, productIDs, lines, order := tallyLines(bill)
+
+	// Lines missing from this version of the bill have been taken off it.
+	var removed []string
+	for lineKey := range record.lines {
+		if _, ok := counts[lineKey]; !ok {
+			removed = append(removed, lineKey)
+		}
+	}
+	sort.Strings(removed)
+	order = append(order, removed...)
+
+	var sales []BillSale
+	for _, lineKey := range order {
+		change := counts[lineKey] - record.lines[lineKey]
+		if change == 0 {
+			continue
+		}
+
+		productID, ok := productIDs[lineKey]
+		if !ok {
+			productID = record.productIDs[lineKey]
+		}
+		sale := BillSale{ProductID: productID, Count: change}
+		if change > 0 {
+			sale.Lines = newestLines(lines[lineKey], change)
+		}
+		sales = append(sales, sale)
+		record.set(lineKey, productID, counts[lineKey])
+	}
+
+	return sales
+}
+
+// Remove takes the lines listed on a void or refund off a bill and returns
+// them as negative sales. Only lines that were counted can be removed, and a
+// void re-sent with the same lastUpdated is only applied once.
+func (ledger *BillLedger) Remove(bill billEventBill, now time.Time) []BillSale {
+	if bill.ID == 0 {
+		return lineSales(bill, -1)
+	}
+
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	record, fresh := ledger.record(bill, now)
+	if !fresh {
+		return nil
+	}
+
+	if bill.LastUpdated != nil {
+		if record.voids[*bill.LastUpdated] {
+			return nil
+		}
+		record.voids[*bill.LastUpdated] = true
+	}
+
+	counts, productIDs, _, order := tallyLines(bill)
+
+	var sales []BillSale
+	for _, lineKey := range order {
+		removed := counts[lineKey]
+		if removed > record.lines[lineKey] {
+			removed = record.lines[lineKey]
+		}
+		if removed <= 0 {
+			continue
+		}
+
+		sales = append(sales, BillSale{ProductID: productIDs[lineKey], Count: -removed})
+		record.set(lineKey, productIDs[lineKey], record.lines[lineKey]-removed)
+	}
+
+	return sales
+}
+
+// record finds or starts the ledger entry for a bill and reports whether the
+// bill is at least as new as the last version seen as of now. It must be
+// called with the ledger lock held.
+func (ledger *BillLedger) record(bill billEventBill, now time.Time) (*billRecord, bool) {
+	ledger.expire(now)
+
+	key := billKey{LocationID: bill.LocationID, BillID: bill.ID}
+	record, ok := ledger.bills[key]
+	if !ok {
+		record = &billRecord{
+			lines:      map[string]int{},
+			productIDs: map[string]int{},
+			voids:      map[string]bool{},
+		}
+		ledger.bills[key] = record
+	}
+	record.seen = now
+
+	// lastUpdated is "2006-01-02 15:04:05", which sorts as a string.
+	if bill.LastUpdated != nil && record.lastUpdated != "" && *bill.LastUpdated < record.lastUpdated {
+		return record, false
+	}
+	if bill.LastUpdated != nil {
+		record.lastUpdated = *bill.LastUpdated
+	}
+
+	return record, true
+}
+
+func (record *billRecord) set(lineKey string, productID int, count int) {
+	if count == 0 {
+		delete(record.lines, lineKey)
+		delete(record.productIDs, lineKey)
+		return
+	}
+
+	record.lines[lineKey] = count
+	record.productIDs[lineKey] = productID
+}
+
+// BillSnapshot is what the ledger remembers of one bill, so a bill re-sent
+// after a restart doesn't count its lines again.
+type BillSnapshot struct {
+	LocationID  int            `json:"locationId"`
+	BillID      int            `json:"billId"`
+	Lines       map[string]int `json:"lines,omitempty"`
+	ProductIDs  map[string]int `json:"productIds,omitempty"`
+	Voids       []string       `json:"voids,omitempty"`
+	LastUpdated string         `json:"lastUpdated,omitempty"`
+	Seen        time.Time      `json:"seen"`
+}
+
+// Snapshot lists the bills the ledger remembers.
+func (ledger *BillLedger) Snapshot() []BillSnapshot {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	var bills []BillSnapshot
+	for key, record := range ledger.bills {
+		bill := BillSnapshot{
+			LocationID:  key.LocationID,
+			BillID:      key.BillID,
+			Lines:       map[string]int{},
+			ProductIDs:  map[string]int{},
+			LastUpdated: record.lastUpdated,
+			Seen:        record.seen,
+		}
+		for lineKey, count := range record.lines {
+			bill.Lines[lineKey] = count
+			bill.ProductIDs[lineKey] = record.productIDs[lineKey]
+		}
+		for lastUpdated := range record.voids {
+			bill.Voids = append(bill.Voids, lastUpdated)
+		}
+		sort.Strings(bill.Voids)
+		bills = append(bills, bill)
+	}
+
+	sort.Slice(bills, func(i, j int) bool {
+		if bills[i].LocationID != bills[j].LocationID {
+			return bills[i].LocationID < bills[j].LocationID
+		}
+		return bills[i].BillID < bills[j].BillID
+	})
+	return bills
+}
+
+// Restore brings back the bills in a snapshot that are still remembered as
+// of now.
+func (ledger *BillLedger) Restore(bills []BillSnapshot, now time.Time) {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	for _, bill := range bills {
+		if now.Sub(bill.Seen) > billRetention {
+			continue
+		}
+
+		record := &billRecord{
+			lines:       map[string]int{},
+			productIDs:  map[string]int{},
+			voids:       map[string]bool{},
+			lastUpdated: bill.LastUpdated,
+			seen:        bill.Seen,
+		}
+		for lineKey, count := range bill.Lines {
+			record.set(lineKey, bill.ProductIDs[lineKey], count)
+		}
+		for _, lastUpdated := range bill.Voids {
+			record.voids[lastUpdated] = true
+		}
+		ledger.bills[billKey{LocationID: bill.LocationID, BillID: bill.BillID}] = record
+	}
+}
+
+// tallyLines totals the quantity on the bill's lines by key, keeping the
+// order they first appear in.
+func tallyLines(bill billEventBill) (map[string]int, map[string]int, map[string][]billEventProduct, []string) {
+	counts := map[string]int{}
+	productIDs := map[string]int{}
+	lines := map[string][]billEventProduct{}
+	var order []string
+	for _, line := range bill.Products {
+		lineKey := line.key()
+		if _, ok := counts[lineKey]; !ok {
+			order = append(order, lineKey)
+		}
+		counts[lineKey] += line.quantity()
+		productIDs[lineKey] = line.ID
+		lines[lineKey] = append(lines[lineKey], line)
+	}
+	return counts, productIDs, lines, order
+}
+
+// newestLines picks lines from the end of the bill until they cover count
+// sales, since a bill grows by having lines added to it.
+func newestLines(lines []billEventProduct, count int) []billEventProduct {
+	i := len(lines)
+	for covered := 0; i > 0 && covered < count; {
+		i--
+		covered += lines[i].quantity()
+	}
+	return lines[i:]
+}
+
+func lineSales(bill billEventBill, sign int) []BillSale {
+	var sales []BillSale
+	for _, line := range bill.Products {
+		sale := BillSale{ProductID: line.ID, Count: sign * line.quantity()}
+		if sale.Count > 0 {
+			sale.Lines = []billEventProduct{line}
+		}
+		sales = append(sales, sale)
+	}
+	return sales
+}
+
+// quantity is how many sales the line is for, negative for a line refunding
+// them. POS systems that don't send a quantity put each item on its own line.
+func (line billEventProduct) quantity() int {
+	quantity := int(math.Round(line.Quantity))
+	switch {
+	case quantity != 0:
+		return quantity
+	case line.Quantity < 0:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// validate refuses bills for more items than maxBillQuantity.
+func (bill billEventBill) validate() error {
+	total := 0
+	for _, line := range bill.Products {
+		if math.Abs(line.Quantity) > maxBillQuantity {
+			return fmt.Errorf("product %d: quantity can't be more than %d", line.ID, maxBillQuantity)
+		}
+		quantity := line.quantity()
+		if quantity < 0 {
+			quantity = -quantity
+		}
+		total += quantity
+	}
+	if total > maxBillQuantity {
+		return fmt.Errorf("bill %d: quantity can't be more than %d in total", bill.ID, maxBillQuantity)
+	}
+	return nil
+}
+
+// charged is the price per item the POS charged, in the minor unit of money.
+func (line billEventProduct) charged(money Money) int {
+	price := line.PriceSold
+	if price == 0 {
+		price = line.Price
+	}
+	return money.Minor(price)
+}
+
+// billTime is when the bill was last changed, or now if the POS didn't say.
+// The POS keeps the venue's local time.
+func (bill billEventBill) billTime(location *time.Location, now time.Time) time.Time {
+	for _, field := range []*string{bill.LastUpdated, bill.OpenedAt} {
+		if field == nil {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", *field, location)
+		if err == nil {
+			return t
+		}
+	}
+	return now
+}
+
+// CheckCharged flags lines of a sale charged at a price other than the one the
+// market showed at the time of the bill. Lines without a price are skipped.
+func (menu *Menu) CheckCharged(bill billEventBill, sale BillSale) {
+	at := bill.billTime(menu.Timetable.Location(), menu.Clock.Now())
+	shown, ok := menu.History.PriceAt(sale.ProductID, at)
+	if !ok {
+		return
+	}
+
+	for _, line := range sale.Lines {
+		charged := line.charged(menu.Money)
+		if charged == 0 || charged == shown {
+			continue
+		}
+
+		mismatch := PriceMismatch{
+			BillID:     bill.ID,
+			LocationID: bill.LocationID,
+			ProductID:  sale.ProductID,
+			Time:       at,
+			Charged:    charged,
+			Shown:      shown,
+		}
+		log.Printf("bill %d at location %d charged %s for product %d, market showed %s",
+			bill.ID, bill.LocationID, menu.Money.Format(charged), sale.ProductID, menu.Money.Format(shown))
+		menu.Bills.flag(mismatch)
+	}
+}
+
+// ApplyBill moves prices for the sales a bill event adds or takes away, and
+// returns the products it moved.
+func (market *Market) ApplyBill(event billEvent) []*Product {
+	menu := market.Menu
+
+	var sales []BillSale
+	switch event.Type {
+	case BillEventVoid, BillEventRefund:
+		sales = menu.Bills.Remove(event.Bill, menu.Clock.Now())
+	default:
+		sales = menu.Bills.Record(event.Bill, menu.Clock.Now())
+	}
+
+	var moved []*Product
+	for _, sale := range sales {
+		menuProduct, err := menu.Product(sale.ProductID)
+		if err != nil {
+			continue
+		}
+
+		menu.CheckCharged(event.Bill, sale)
+
+		for i := 0; i < sale.Count; i++ {
+			menuProduct.IncrPrice()
+		}
+		for i := 0; i > sale.Count; i-- {
+			menuProduct.ReversePrice()
+		}
+		menu.History.RecordSales(sale.ProductID, sale.Count, menuProduct.Current())
+		moved = append(moved, menuProduct)
+
+		if sale.Count > 0 {
+			for _, rule := range menu.Demand.Sale(menuProduct.Category, sale.Count, menu.Clock.Now()) {
+				menu.CrashAll(rule)
+			}
+		}
+	}
+
+	return moved
+}
+
+func (ledger *BillLedger) flag(mismatch PriceMismatch) {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	ledger.mismatches = append(ledger.mismatches, mismatch)
+	if len(ledger.mismatches) > maxMismatches {
+		ledger.mismatches = ledger.mismatches[len(ledger.mismatches)-maxMismatches:]
+	}
+}
+
+func (ledger *BillLedger) Mismatches() []PriceMismatch {
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	mismatches := make([]PriceMismatch, len(ledger.mismatches))
+	copy(mismatches, ledger.mismatches)
+	return mismatches
+}
+
+type mismatchResponse struct {
+	BillID       int       `json:"billId"`
+	LocationID   int       `json:"locationId"`
+	ProductID    int       `json:"productId"`
+	Time         time.Time `json:"time"`
+	Charged      string    `json:"charged"`
+	Shown        string    `json:"shown"`
+	ChargedMinor int       `json:"chargedMinor"`
+	ShownMinor   int       `json:"shownMinor"`
+}
+
+type mismatchesResponse struct {
+	Mismatches []mismatchResponse `json:"mismatches"`
+}
+
+func priceMismatches(w http.ResponseWriter, r *http.Request, market *Market) {
+	money := market.Menu.Money
+	response := mismatchesResponse{Mismatches: []mismatchResponse{}}
+	for _, mismatch := range market.Menu.Bills.Mismatches() {
+		response.Mismatches = append(response.Mismatches, mismatchResponse{
+			BillID:       mismatch.BillID,
+			LocationID:   mismatch.LocationID,
+			ProductID:    mismatch.ProductID,
+			Time:         mismatch.Time,
+			Charged:      money.Format(mismatch.Charged),
+			Shown:        money.Format(mismatch.Shown),
+			ChargedMinor: mismatch.Charged,
+			ShownMinor:   mismatch.Shown,
+		})
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// expire must be called with the ledger lock held.
+func (ledger *BillLedger) expire(now time.Time) {
+	if now.Sub(ledger.expired) < time.Minute {
+		return
+	}
+	ledger.expired = now
+
+	for key, record := range ledger.bills {
+		if now.Sub(record.seen) > billRetention {
+			delete(ledger.bills, key)
+		}
+	}
+}
+
+// key identifies a line within its bill. Lines the POS gives an id to are
+// matched on it; otherwise lines are matched by product, so a bill that gains
+// a second Stella counts one more sale.
+func (line billEventProduct) key() string {
+	id := strings.Trim(string(line.LineID), `"`)
+	if id != "" && id != "null" {
+		return fmt.Sprintf("line:%s", id)
+	}
+	return fmt.Sprintf("product:%d", line.ID)
+}
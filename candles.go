@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var candleIntervals = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+}
+
+// maxCandles bounds how many candles one request can ask for.
+const maxCandles = 10000
+
+type Candle struct {
+	Time   time.Time
+	Open   int
+	High   int
+	Low    int
+	Close  int
+	Volume int
+}
+
+// Candles buckets price points into intervals from since up to until, or
+// from the first point if since is earlier or zero. Each candle opens at the
+// price carried over from the one before, and intervals with no activity are
+// flat so charts don't have gaps. Volume is the sales made in the interval,
+// net of sales taken back, whether or not they moved the price.
+func Candles(points, sales []PricePoint, interval time.Duration, since, until time.Time) []Candle {
+	if len(points) == 0 {
+		return nil
+	}
+
+	var candles []Candle
+	start := candleStart(points, interval, since)
+	if !start.Before(until) {
+		return nil
+	}
+	price := points[0].Price
+	for len(points) > 0 && points[0].Time.Before(start) {
+		price = points[0].Price
+		points = points[1:]
+	}
+	for len(sales) > 0 && sales[0].Time.Before(start) {
+		sales = sales[1:]
+	}
+
+	for bucket := start; bucket.Before(until); bucket = bucket.Add(interval) {
+		candle := Candle{Time: bucket, Open: price, High: price, Low: price}
+		end := bucket.Add(interval)
+
+		for len(points) > 0 && points[0].Time.Before(end) {
+			point := points[0]
+			points = points[1:]
+
+			price = point.Price
+			if price > candle.High {
+				candle.High = price
+			}
+			if price < candle.Low {
+				candle.Low = price
+			}
+		}
+		for len(sales) > 0 && sales[0].Time.Before(end) {
+			candle.Volume += sales[0].Sales
+			sales = sales[1:]
+		}
+
+		candle.Close = price
+		candles = append(candles, candle)
+	}
+
+	return candles
+}
+
+// candleStart is when the first candle of points from since begins.
+func candleStart(points []PricePoint, interval time.Duration, since time.Time) time.Time {
+	start := points[0].Time.Truncate(interval)
+	if since.After(start) {
+		start = since.Truncate(interval)
+	}
+	return start
+}
+
+type candleResponse struct {
+	Time       time.Time `json:"time"`
+	Open       string    `json:"open"`
+	High       string    `json:"high"`
+	Low        string    `json:"low"`
+	Close      string    `json:"close"`
+	OpenMinor  int       `json:"openMinor"`
+	HighMinor  int       `json:"highMinor"`
+	LowMinor   int       `json:"lowMinor"`
+	CloseMinor int       `json:"closeMinor"`
+	Volume     int       `json:"volume"`
+}
+
+type candlesResponse struct {
+	ID       int              `json:"id"`
+	Interval string           `json:"interval"`
+	Candles  []candleResponse `json:"candles"`
+}
+
+func priceCandles(w http.ResponseWriter, r *http.Request, market *Market) {
+	productID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	_, err := market.Menu.Lookup(productID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	name := r.URL.Query().Get("interval")
+	if name == "" {
+		name = "1m"
+	}
+	interval, ok := candleIntervals[name]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("interval must be one of 1m, 5m or 15m"))
+		return
+	}
+
+	since, until, err := timeRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// There are no candles to draw after now.
+	if now := market.Menu.Clock.Now(); until.IsZero() || until.After(now) {
+		until = now
+	}
+
+	money := market.Menu.Money
+	response := candlesResponse{ID: productID, Interval: name, Candles: []candleResponse{}}
+	points := market.Menu.History.Between(productID, time.Time{}, until)
+	sales := market.Menu.History.SalesBetween(productID, time.Time{}, until)
+	if len(points) > 0 && until.Sub(candleStart(points, interval, since)) > maxCandles*interval {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("range covers more than %d candles; narrow it or use a longer interval", maxCandles)))
+		return
+	}
+	for _, candle := range Candles(points, sales, interval, since, until) {
+		response.Candles = append(response.Candles, candleResponse{
+			Time:       candle.Time,
+			Open:       money.Format(candle.Open),
+			High:       money.Format(candle.High),
+			Low:        money.Format(candle.Low),
+			Close:      money.Format(candle.Close),
+			OpenMinor:  candle.Open,
+			HighMinor:  candle.High,
+			LowMinor:   candle.Low,
+			CloseMinor: candle.Close,
+			Volume:     candle.Volume,
+		})
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
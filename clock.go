@@ -0,0 +1,240 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where products get the time and wait for it to pass. Products run
+// on the real clock unless given a ManualClock, which lets tests and
+// simulations move time on without waiting for it.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	After(d time.Duration) <-chan time.Time
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+// RealClock is the system clock.
+func RealClock() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{timer: time.NewTimer(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (timer realTimer) C() <-chan time.Time {
+	return timer.timer.C
+}
+
+func (timer realTimer) Stop() bool {
+	return timer.timer.Stop()
+}
+
+// ManualClock only moves when it is advanced. Timers fire once the clock has
+// been advanced past them.
+type ManualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (clock *ManualClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	return clock.now
+}
+
+func (clock *ManualClock) NewTimer(d time.Duration) Timer {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	timer := &manualTimer{clock: clock, at: clock.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- clock.now
+		return timer
+	}
+
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+func (clock *ManualClock) After(d time.Duration) <-chan time.Time {
+	return clock.NewTimer(d).C()
+}
+
+// Advance moves the clock on by d and fires every timer that is then due.
+func (clock *ManualClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = clock.now.Add(d)
+
+	var pending []*manualTimer
+	for _, timer := range clock.timers {
+		if timer.at.After(clock.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- clock.now
+	}
+	clock.timers = pending
+}
+
+// Timers is how many timers are waiting to fire. Products start their timers
+// in the background, so wait for them before advancing the clock.
+func (clock *ManualClock) Timers() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	return len(clock.timers)
+}
+
+func (timer *manualTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *manualTimer) Stop() bool {
+	clock := timer.clock
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	for i, pending := range clock.timers {
+		if pending == timer {
+			clock.timers = append(clock.timers[:i:i], clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ReplayClock stands at the time of the entry being replayed until it goes
+// live, then follows the real clock. Timers started during replay fire as
+// replay passes them, or in real time if they are still waiting when the
+// clock goes live.
+type ReplayClock struct {
+	lock   sync.RWMutex
+	manual *ManualClock
+	live   bool
+}
+
+func NewReplayClock(start time.Time) *ReplayClock {
+	return &ReplayClock{manual: NewManualClock(start)}
+}
+
+func (clock *ReplayClock) Now() time.Time {
+	clock.lock.RLock()
+	defer clock.lock.RUnlock()
+
+	if clock.live {
+		return time.Now()
+	}
+	return clock.manual.Now()
+}
+
+func (clock *ReplayClock) NewTimer(d time.Duration) Timer {
+	clock.lock.RLock()
+	defer clock.lock.RUnlock()
+
+	if clock.live {
+		return realClock{}.NewTimer(d)
+	}
+	return clock.manual.NewTimer(d)
+}
+
+func (clock *ReplayClock) After(d time.Duration) <-chan time.Time {
+	return clock.NewTimer(d).C()
+}
+
+// Set moves the clock to t, firing every timer that is then due. It does
+// nothing once the clock is live.
+func (clock *ReplayClock) Set(t time.Time) {
+	clock.lock.RLock()
+	defer clock.lock.RUnlock()
+
+	if clock.live {
+		return
+	}
+	clock.manual.Advance(t.Sub(clock.manual.Now()))
+}
+
+// Live ends replay. Timers that are due by now fire straight away and the
+// rest fire when their time comes.
+func (clock *ReplayClock) Live() {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	if clock.live {
+		return
+	}
+	clock.live = true
+	clock.manual.release()
+}
+
+// release fires the timers due by the real time and leaves the rest to fire
+// in real time, unless they are stopped first.
+func (clock *ManualClock) release() {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	now := time.Now()
+	if now.After(clock.now) {
+		clock.now = now
+	}
+
+	var pending []*manualTimer
+	for _, timer := range clock.timers {
+		if timer.at.After(clock.now) {
+			pending = append(pending, timer)
+			timer := timer
+			time.AfterFunc(timer.at.Sub(clock.now), func() { clock.fire(timer) })
+			continue
+		}
+		timer.c <- clock.now
+	}
+	clock.timers = pending
+}
+
+// fire sends on a released timer that hasn't been stopped.
+func (clock *ManualClock) fire(timer *manualTimer) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	for i, pending := range clock.timers {
+		if pending == timer {
+			clock.timers = append(clock.timers[:i:i], clock.timers[i+1:]...)
+			timer.c <- time.Now()
+			return
+		}
+	}
+}
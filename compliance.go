@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxClamps bounds how many clamped prices a market keeps.
+const maxClamps = 1000
+
+// Clamp is a price the market would have charged for a product that the
+// legal minimum raised.
+type Clamp struct {
+	Time      time.Time `json:"time"`
+	ProductID int       `json:"productId"`
+	Cause     string    `json:"cause"`
+	Price     int       `json:"price"`
+	Floor     int       `json:"floor"`
+	Reason    string    `json:"reason"`
+}
+
+// Compliance keeps the prices a market's legal floors raised, oldest first.
+type Compliance struct {
+	lock   sync.RWMutex
+	clamps []Clamp
+}
+
+func (compliance *Compliance) Record(clamp Clamp) {
+	if compliance == nil {
+		return
+	}
+
+	compliance.lock.Lock()
+	defer compliance.lock.Unlock()
+
+	compliance.clamps = append(compliance.clamps, clamp)
+	if len(compliance.clamps) > maxClamps {
+		compliance.clamps = compliance.clamps[len(compliance.clamps)-maxClamps:]
+	}
+}
+
+func (compliance *Compliance) Clamps() []Clamp {
+	compliance.lock.RLock()
+	defer compliance.lock.RUnlock()
+
+	return append([]Clamp{}, compliance.clamps...)
+}
+
+// Restore brings back the clamps in a snapshot.
+func (compliance *Compliance) Restore(clamps []Clamp) {
+	compliance.lock.Lock()
+	defer compliance.lock.Unlock()
+
+	compliance.clamps = append([]Clamp{}, clamps...)
+}
+
+// Units is how many units of alcohol one serving of the product holds.
+func (product *Product) Units() float64 {
+	return units(product.ABV, product.Volume)
+}
+
+// legalFloor is the lowest price the law allows the product to sell at, or 0
+// if no minimum unit price applies to it.
+func (product *Product) legalFloor() int {
+	return legalFloor(product.unitPrice, product.ABV, product.Volume)
+}
+
+// units is how many units of alcohol are in volume millilitres of a drink of
+// abv percent alcohol.
+func units(abv float64, volume int) float64 {
+	return abv * float64(volume) / 1000
+}
+
+// legalFloor is the minimum price of a serving at unitPrice pence a unit,
+// rounded up to the penny so it is never under.
+func legalFloor(unitPrice int, abv float64, volume int) int {
+	// Rounded to a thousandth of a penny first, so float error can't push
+	// an exact price up a penny.
+	pence := math.Round(units(abv, volume)*float64(unitPrice)*1000) / 1000
+	return int(math.Ceil(pence))
+}
+
+// clamp raises a price the market proposed for cause to the product's floor.
+// A price only the legal minimum held up is reported to compliance, once each
+// time the price moves onto the legal floor. It must be called with the
+// product lock held.
+func (product *Product) clamp(price int, cause string) int {
+	floor := product.minPrice()
+	if price >= floor {
+		return price
+	}
+
+	wanted := price
+	if market := product.marketFloor(); market > wanted {
+		wanted = market
+	}
+	legal := product.legalFloor()
+	if wanted < legal && product.currentPrice != legal {
+		product.compliance.Record(Clamp{
+			Time:      product.clock.Now(),
+			ProductID: product.ID,
+			Cause:     cause,
+			Price:     wanted,
+			Floor:     legal,
+			Reason: fmt.Sprintf("minimum unit price in %s: %.2f units at %dp a unit",
+				product.jurisdiction, product.Units(), product.unitPrice),
+		})
+	}
+
+	return floor
+}
+
+type legalFloorResponse struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	Units      float64 `json:"units"`
+	Floor      string  `json:"floor"`
+	FloorMinor int     `json:"floorMinor"`
+}
+
+type clampResponse struct {
+	Time       time.Time `json:"time"`
+	ProductID  int       `json:"productId"`
+	Cause      string    `json:"cause"`
+	Price      string    `json:"price"`
+	Floor      string    `json:"floor"`
+	PriceMinor int       `json:"priceMinor"`
+	FloorMinor int       `json:"floorMinor"`
+	Reason     string    `json:"reason"`
+}
+
+type complianceResponse struct {
+	Jurisdiction   string               `json:"jurisdiction,omitempty"`
+	UnitPrice      string               `json:"unitPrice,omitempty"`
+	UnitPriceMinor int                  `json:"unitPriceMinor,omitempty"`
+	Floors         []legalFloorResponse `json:"floors"`
+	Clamps         []clampResponse      `json:"clamps"`
+}
+
+// serveCompliance reports the legal floor of every product on sale that has
+// one, and every price the market would have charged below it.
+func serveCompliance(w http.ResponseWriter, r *http.Request, market *Market) {
+	money := market.Menu.Money
+	response := complianceResponse{
+		Floors: []legalFloorResponse{},
+		Clamps: []clampResponse{},
+	}
+
+	jurisdiction := market.Config.Market.Jurisdiction
+	if unitPrice, ok := market.Config.MinimumUnitPrices[jurisdiction]; ok {
+		response.Jurisdiction = jurisdiction
+		response.UnitPrice = money.Format(unitPrice)
+		response.UnitPriceMinor = unitPrice
+	}
+
+	for _, product := range market.Menu.Products() {
+		product.lock.RLock()
+		if floor := product.legalFloor(); floor > 0 {
+			response.Floors = append(response.Floors, legalFloorResponse{
+				ID:         product.ID,
+				Name:       product.Name,
+				Units:      math.Round(product.Units()*100) / 100,
+				Floor:      money.Format(floor),
+				FloorMinor: floor,
+			})
+		}
+		product.lock.RUnlock()
+	}
+
+	for _, clamp := range market.Menu.Compliance.Clamps() {
+		response.Clamps = append(response.Clamps, clampResponse{
+			Time:       clamp.Time,
+			ProductID:  clamp.ProductID,
+			Cause:      clamp.Cause,
+			Price:      money.Format(clamp.Price),
+			Floor:      money.Format(clamp.Floor),
+			PriceMinor: clamp.Price,
+			FloorMinor: clamp.Floor,
+			Reason:     clamp.Reason,
+		})
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
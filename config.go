@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v2"
+)
+
+// Config describes the menu a bar sells and how its market behaves. Settings
+// under market apply to every product unless the product overrides them.
+// A deployment serving several bars lists them under locations; the
+// top-level products, if any, are sold wherever a bill's location isn't
+// listed.
+type Config struct {
+	Market     MarketConfig     `yaml:"market"`
+	History    HistoryConfig    `yaml:"history"`
+	Snapshot   SnapshotConfig   `yaml:"snapshot"`
+	EventLog   EventLogConfig   `yaml:"event_log"`
+	Shutdown   ShutdownConfig   `yaml:"shutdown"`
+	Products   []ProductConfig  `yaml:"products"`
+	CrashRules []CrashRule      `yaml:"crash_rules"`
+	Timezone   string           `yaml:"timezone"`
+	Schedules  []ScheduleConfig `yaml:"schedules"`
+	Locations  []LocationConfig `yaml:"locations"`
+
+	// MinimumUnitPrices is the legal minimum price of a unit of alcohol, in
+	// pence, in each jurisdiction that has one. Markets set the
+	// jurisdiction they are in.
+	MinimumUnitPrices map[string]int `yaml:"minimum_unit_prices"`
+
+	positions configPositions
+}
+
+// LocationConfig is one venue in a multi-venue deployment. Market settings
+// given here override the top-level ones for this venue only.
+type LocationConfig struct {
+	ID         int              `yaml:"id"`
+	Name       string           `yaml:"name"`
+	Market     yaml.MapSlice    `yaml:"market"`
+	History    HistoryConfig    `yaml:"history"`
+	Products   []ProductConfig  `yaml:"products"`
+	CrashRules []CrashRule      `yaml:"crash_rules"`
+	Timezone   string           `yaml:"timezone"`
+	Schedules  []ScheduleConfig `yaml:"schedules"`
+}
+
+type MarketConfig struct {
+	LowRatio       float64        `yaml:"low_ratio"`
+	CrashRatio     float64        `yaml:"crash_ratio"`
+	PriceIncrement float64        `yaml:"price_increment"`
+	ClockPeriod    time.Duration  `yaml:"clock_period"`
+	Strategy       StrategyConfig `yaml:"strategy"`
+	RefundMode     string         `yaml:"refund_mode"`
+	CrashWindow    time.Duration  `yaml:"crash_window"`
+	CrashCooldown  time.Duration  `yaml:"crash_cooldown"`
+	CrashHold      int            `yaml:"crash_hold"`
+	MinMargin      int            `yaml:"min_margin"`
+	Jurisdiction   string         `yaml:"jurisdiction"`
+	Rounding       RoundingConfig `yaml:"rounding"`
+	Currency       string         `yaml:"currency"`
+	Locale         string         `yaml:"locale"`
+}
+
+// HistoryConfig bounds how many price changes are kept in memory per product
+// and optionally names a file to persist them to.
+type HistoryConfig struct {
+	Size int    `yaml:"size"`
+	Path string `yaml:"path"`
+}
+
+// SnapshotConfig names a file the state of every market is saved to every
+// interval and restored from on startup.
+type SnapshotConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// EventLogConfig names a file every bill event and clock tick is appended
+// to, for replaying the market.
+type EventLogConfig struct {
+	Path string `yaml:"path"`
+}
+
+// ShutdownConfig bounds how long in-flight requests get to finish when the
+// service is stopped.
+type ShutdownConfig struct {
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ShutdownTimeout is how long in-flight requests get to finish when the
+// configuration doesn't say.
+const ShutdownTimeout = 10 * time.Second
+
+// SnapshotInterval is how often a snapshot is saved when the configuration
+// doesn't say.
+const SnapshotInterval = 30 * time.Second
+
+type ProductConfig struct {
+	ID             int             `yaml:"id"`
+	Name           string          `yaml:"name"`
+	Category       string          `yaml:"category"`
+	BasePrice      int             `yaml:"base_price"`
+	CostPrice      int             `yaml:"cost_price"`
+	ABV            float64         `yaml:"abv"`
+	Volume         int             `yaml:"volume_ml"`
+	LowRatio       *float64        `yaml:"low_ratio"`
+	CrashRatio     *float64        `yaml:"crash_ratio"`
+	PriceIncrement *float64        `yaml:"price_increment"`
+	ClockPeriod    *time.Duration  `yaml:"clock_period"`
+	Strategy       *StrategyConfig `yaml:"strategy"`
+	RefundMode     *string         `yaml:"refund_mode"`
+	CrashWindow    *time.Duration  `yaml:"crash_window"`
+	CrashCooldown  *time.Duration  `yaml:"crash_cooldown"`
+	CrashHold      *int            `yaml:"crash_hold"`
+	MinMargin      *int            `yaml:"min_margin"`
+	Rounding       *RoundingConfig `yaml:"rounding"`
+}
+
+// StrategyConfig selects a PricingStrategy by name. Fields that a strategy
+// doesn't use are ignored.
+type StrategyConfig struct {
+	Type       string  `yaml:"type"`
+	Step       int     `yaml:"step"`
+	Decay      float64 `yaml:"decay"`
+	Elasticity float64 `yaml:"elasticity"`
+}
+
+const (
+	StrategyStep        = "step"
+	StrategyLinear      = "linear"
+	StrategyExponential = "exponential"
+	StrategyElasticity  = "elasticity"
+)
+
+// ConfigError points at the line of the configuration file that caused it.
+type ConfigError struct {
+	Line    int
+	Message string
+}
+
+func (err *ConfigError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.Line, err.Message)
+}
+
+func DefaultMarketConfig() MarketConfig {
+	return MarketConfig{
+		LowRatio:       LowRatio,
+		CrashRatio:     CrashRatio,
+		PriceIncrement: PriceIncrement,
+		ClockPeriod:    ClockPeriodMinutes * time.Minute,
+		Strategy:       StrategyConfig{Type: StrategyStep},
+		RefundMode:     RefundUndo,
+		CrashWindow:    CrashWindow,
+		Currency:       DefaultCurrency,
+		Locale:         "en-GB",
+	}
+}
+
+// DefaultConfig is the menu the market runs with when no configuration file
+// is given.
+func DefaultConfig() Config {
+	return Config{
+		Market:   DefaultMarketConfig(),
+		Snapshot: SnapshotConfig{Interval: SnapshotInterval},
+		Shutdown: ShutdownConfig{Timeout: ShutdownTimeout},
+		Products: []ProductConfig{
+			{ID: 1, Name: "Stella", BasePrice: 540},
+			{ID: 2, Name: "Carlsberg", BasePrice: 480},
+			{ID: 3, Name: "Coors Light", BasePrice: 420},
+			{ID: 4, Name: "Carling", BasePrice: 480},
+			{ID: 5, Name: "Budweiser", BasePrice: 480},
+		},
+	}
+}
+
+func LoadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config, err := ParseConfig(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return config, nil
+}
+
+func ParseConfig(data []byte) (Config, error) {
+	config := Config{
+		Market:   DefaultMarketConfig(),
+		Snapshot: SnapshotConfig{Interval: SnapshotInterval},
+		Shutdown: ShutdownConfig{Timeout: ShutdownTimeout},
+	}
+
+	err := yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config.positions = configLines(data)
+
+	err = config.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+func (config Config) Validate() error {
+	if len(config.Products) == 0 && len(config.Locations) == 0 {
+		return &ConfigError{Line: 1, Message: "no products configured"}
+	}
+
+	err := config.validateMenu("", config.line)
+	if err != nil {
+		return err
+	}
+
+	if config.Snapshot.Interval <= 0 {
+		return &ConfigError{Line: config.line("snapshot", -1), Message: "snapshot: interval must be positive"}
+	}
+	if config.Shutdown.Timeout <= 0 {
+		return &ConfigError{Line: config.line("shutdown", -1), Message: "shutdown: timeout must be positive"}
+	}
+	for jurisdiction, unitPrice := range config.MinimumUnitPrices {
+		if unitPrice <= 0 {
+			return &ConfigError{Line: config.line("minimum_unit_prices", -1), Message: fmt.Sprintf("minimum_unit_prices: %s must be a positive number of pence", jurisdiction)}
+		}
+	}
+
+	seen := map[int]bool{}
+	for i, location := range config.Locations {
+		line := config.line("locations", i)
+		at := func(string, int) int { return line }
+
+		if location.ID <= 0 {
+			return &ConfigError{Line: line, Message: fmt.Sprintf("location %d: id must be a positive number", i+1)}
+		}
+		if seen[location.ID] {
+			return &ConfigError{Line: line, Message: fmt.Sprintf("location %d: id is used by another location", location.ID)}
+		}
+		seen[location.ID] = true
+
+		resolved, err := config.Location(location)
+		if err != nil {
+			return &ConfigError{Line: line, Message: fmt.Sprintf("location %d: %s", location.ID, err)}
+		}
+		if len(resolved.Products) == 0 {
+			return &ConfigError{Line: line, Message: fmt.Sprintf("location %d: no products configured", location.ID)}
+		}
+
+		err = resolved.validateMenu(fmt.Sprintf("location %d: ", location.ID), at)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateMenu checks the market settings, history, products and crash rules
+// of one venue. at gives the line of a top-level block, or of an entry in a
+// list.
+func (config Config) validateMenu(prefix string, at func(key string, i int) int) error {
+	err := validateSettings(config.Market)
+	if err != nil {
+		return &ConfigError{Line: at("market", -1), Message: fmt.Sprintf("%smarket: %s", prefix, err)}
+	}
+	if jurisdiction := config.Market.Jurisdiction; jurisdiction != "" {
+		if _, ok := config.MinimumUnitPrices[jurisdiction]; !ok {
+			return &ConfigError{Line: at("market", -1), Message: fmt.Sprintf("%smarket: no minimum_unit_prices for jurisdiction %q", prefix, jurisdiction)}
+		}
+	}
+
+	if config.History.Size < 0 {
+		return &ConfigError{Line: at("history", -1), Message: prefix + "history: size can't be negative"}
+	}
+
+	seen := map[int]bool{}
+	for i, product := range config.Products {
+		err := config.validateProduct(product, seen)
+		if err != nil {
+			return &ConfigError{Line: at("products", i), Message: fmt.Sprintf("%sproduct %d: %s", prefix, i+1, err)}
+		}
+		seen[product.ID] = true
+	}
+
+	for i, rule := range config.CrashRules {
+		err := config.validateCrashRule(rule)
+		if err != nil {
+			return &ConfigError{Line: at("crash_rules", i), Message: fmt.Sprintf("%scrash rule %d: %s", prefix, i+1, err)}
+		}
+	}
+
+	_, err = time.LoadLocation(config.Timezone)
+	if err != nil {
+		return &ConfigError{Line: at("timezone", -1), Message: fmt.Sprintf("%stimezone: %s", prefix, err)}
+	}
+
+	names := map[string]bool{}
+	for i, schedule := range config.Schedules {
+		err := config.validateSchedule(schedule, names)
+		if err != nil {
+			return &ConfigError{Line: at("schedules", i), Message: fmt.Sprintf("%sschedule %d: %s", prefix, i+1, err)}
+		}
+		names[schedule.Name] = true
+	}
+
+	return nil
+}
+
+func (config Config) validateSchedule(schedule ScheduleConfig, names map[string]bool) error {
+	_, err := schedule.Schedule()
+	if err != nil {
+		return err
+	}
+	if names[schedule.Name] {
+		return fmt.Errorf("name %q is used by another schedule", schedule.Name)
+	}
+
+	for _, product := range config.Products {
+		settings := config.scheduleSettings(schedule, product)
+		err := validateSettings(settings)
+		if err == nil {
+			err = config.validateFloor(product, settings)
+		}
+		if err != nil {
+			return fmt.Errorf("product %d: %s", product.ID, err)
+		}
+	}
+	return nil
+}
+
+func (config Config) validateCrashRule(rule CrashRule) error {
+	if rule.Sales <= 0 {
+		return fmt.Errorf("sales must be a positive number")
+	}
+	if rule.Window <= 0 {
+		return fmt.Errorf("window must be greater than 0")
+	}
+	// Without top-level products there's no default market for the rule to
+	// crash; each location checks the rules it inherits against its own menu.
+	if rule.Category == "" || len(config.Products) == 0 {
+		return nil
+	}
+
+	for _, product := range config.Products {
+		if product.Category == rule.Category {
+			return nil
+		}
+	}
+	return fmt.Errorf("no products are in category %q", rule.Category)
+}
+
+// Location resolves the configuration of one venue. Its market settings
+// start from the top-level ones and override only what they name.
+func (config Config) Location(location LocationConfig) (Config, error) {
+	resolved := Config{
+		Market:     config.Market,
+		History:    location.History,
+		Products:   location.Products,
+		CrashRules: config.CrashRules,
+		Timezone:   config.Timezone,
+		Schedules:  config.Schedules,
+
+		MinimumUnitPrices: config.MinimumUnitPrices,
+	}
+	if len(location.CrashRules) > 0 {
+		resolved.CrashRules = location.CrashRules
+	}
+	if location.Timezone != "" {
+		resolved.Timezone = location.Timezone
+	}
+	if len(location.Schedules) > 0 {
+		resolved.Schedules = location.Schedules
+	}
+
+	if len(location.Market) > 0 {
+		data, err := yaml.Marshal(location.Market)
+		if err != nil {
+			return Config{}, err
+		}
+		err = yaml.UnmarshalStrict(data, &resolved.Market)
+		if err != nil {
+			return Config{}, fmt.Errorf("market: %s", err)
+		}
+	}
+
+	return resolved, nil
+}
+
+func (config Config) validateProduct(product ProductConfig, seen map[int]bool) error {
+	if product.ID <= 0 {
+		return fmt.Errorf("id must be a positive number")
+	}
+	if seen[product.ID] {
+		return fmt.Errorf("id %d is used by another product", product.ID)
+	}
+	if strings.TrimSpace(product.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if product.BasePrice <= 0 {
+		return fmt.Errorf("base_price must be a positive number of pence")
+	}
+	if product.CostPrice < 0 {
+		return fmt.Errorf("cost_price can't be negative")
+	}
+	if product.ABV < 0 || product.ABV > 100 {
+		return fmt.Errorf("abv must be a percentage")
+	}
+	if product.Volume < 0 {
+		return fmt.Errorf("volume_ml can't be negative")
+	}
+	if product.ABV > 0 && product.Volume == 0 {
+		return fmt.Errorf("volume_ml is needed with abv")
+	}
+
+	settings := config.settings(product)
+	err := validateSettings(settings)
+	if err != nil {
+		return err
+	}
+	return config.validateFloor(product, settings)
+}
+
+// validateFloor checks a product's floor, which its cost price, minimum
+// margin and the legal minimum can raise, is no higher than the price it
+// crashes from.
+func (config Config) validateFloor(product ProductConfig, settings MarketConfig) error {
+	floor := priceFloor(product.BasePrice, settings.LowRatio, product.CostPrice, settings.MinMargin)
+	if legal := legalFloor(config.MinimumUnitPrices[settings.Jurisdiction], product.ABV, product.Volume); legal > floor {
+		floor = legal
+	}
+	ceiling := int(float64(product.BasePrice) * settings.CrashRatio)
+	if floor > ceiling {
+		money := settings.Money()
+		return fmt.Errorf("floor of %s is above the crash price of %s", money.Format(floor), money.Format(ceiling))
+	}
+	return nil
+}
+
+func validateSettings(settings MarketConfig) error {
+	if settings.LowRatio <= 0 {
+		return fmt.Errorf("low_ratio must be greater than 0")
+	}
+	if settings.CrashRatio <= settings.LowRatio {
+		return fmt.Errorf("crash_ratio must be greater than low_ratio")
+	}
+	if settings.PriceIncrement <= 0 {
+		return fmt.Errorf("price_increment must be greater than 0")
+	}
+	if settings.ClockPeriod <= 0 {
+		return fmt.Errorf("clock_period must be greater than 0")
+	}
+
+	if settings.CrashWindow <= 0 {
+		return fmt.Errorf("crash_window must be greater than 0")
+	}
+	if settings.CrashCooldown < 0 {
+		return fmt.Errorf("crash_cooldown can't be negative")
+	}
+	if settings.CrashHold < 0 {
+		return fmt.Errorf("crash_hold can't be negative")
+	}
+	if settings.MinMargin < 0 {
+		return fmt.Errorf("min_margin can't be negative")
+	}
+
+	switch settings.RefundMode {
+	case "", RefundUndo, RefundTick:
+	default:
+		return fmt.Errorf("refund_mode must be %q or %q", RefundUndo, RefundTick)
+	}
+
+	strategy := settings.Strategy
+	switch strategy.Type {
+	case "", StrategyStep, StrategyElasticity:
+	case StrategyLinear:
+		if strategy.Step <= 0 {
+			return fmt.Errorf("linear strategy needs a positive step")
+		}
+	case StrategyExponential:
+		if strategy.Decay <= 0 || strategy.Decay >= 1 {
+			return fmt.Errorf("exponential strategy needs a decay between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("unknown strategy %q", strategy.Type)
+	}
+
+	if _, ok := currencies[settings.Currency]; !ok && settings.Currency != "" {
+		return fmt.Errorf("unknown currency %q", settings.Currency)
+	}
+	if _, err := language.Parse(settings.Locale); err != nil && settings.Locale != "" {
+		return fmt.Errorf("locale: %s", err)
+	}
+
+	return settings.Rounding.validate()
+}
+
+// Money writes prices in the market's currency and locale.
+func (settings MarketConfig) Money() Money {
+	return NewMoney(currencies[settings.Currency], language.Make(settings.Locale))
+}
+
+// settings resolves the market defaults a product doesn't override.
+func (config Config) settings(product ProductConfig) MarketConfig {
+	settings := config.Market
+	if product.LowRatio != nil {
+		settings.LowRatio = *product.LowRatio
+	}
+	if product.CrashRatio != nil {
+		settings.CrashRatio = *product.CrashRatio
+	}
+	if product.PriceIncrement != nil {
+		settings.PriceIncrement = *product.PriceIncrement
+	}
+	if product.ClockPeriod != nil {
+		settings.ClockPeriod = *product.ClockPeriod
+	}
+	if product.Strategy != nil {
+		settings.Strategy = *product.Strategy
+	}
+	if product.RefundMode != nil {
+		settings.RefundMode = *product.RefundMode
+	}
+	if product.CrashWindow != nil {
+		settings.CrashWindow = *product.CrashWindow
+	}
+	if product.CrashCooldown != nil {
+		settings.CrashCooldown = *product.CrashCooldown
+	}
+	if product.CrashHold != nil {
+		settings.CrashHold = *product.CrashHold
+	}
+	if product.MinMargin != nil {
+		settings.MinMargin = *product.MinMargin
+	}
+	if product.Rounding != nil {
+		settings.Rounding = *product.Rounding
+	}
+	return settings
+}
+
+// scheduleSettings resolves a product's settings while schedule is active.
+// The schedule's ratios replace the market's, and the product's own
+// overrides still apply on top.
+func (config Config) scheduleSettings(schedule ScheduleConfig, product ProductConfig) MarketConfig {
+	if schedule.LowRatio != nil {
+		config.Market.LowRatio = *schedule.LowRatio
+	}
+	if schedule.CrashRatio != nil {
+		config.Market.CrashRatio = *schedule.CrashRatio
+	}
+	if schedule.PriceIncrement != nil {
+		config.Market.PriceIncrement = *schedule.PriceIncrement
+	}
+	return config.settings(product)
+}
+
+// priceSets resolves the ratios and strategy a product prices by under each
+// schedule, and outside them all.
+func (config Config) priceSets(product ProductConfig) map[string]PriceSet {
+	priceSet := func(settings MarketConfig) PriceSet {
+		return PriceSet{
+			LowRatio:   settings.LowRatio,
+			CrashRatio: settings.CrashRatio,
+			Strategy:   settings.Strategy.Strategy(settings.PriceIncrement),
+		}
+	}
+
+	sets := map[string]PriceSet{"": priceSet(config.settings(product))}
+	for _, schedule := range config.Schedules {
+		sets[schedule.Name] = priceSet(config.scheduleSettings(schedule, product))
+	}
+	return sets
+}
+
+// timetable parses the schedules, which have been validated, in the venue's
+// time zone.
+func (config Config) timetable(clock Clock) (*Timetable, error) {
+	location := time.Local
+	if config.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var schedules []Schedule
+	for _, scheduleConfig := range config.Schedules {
+		schedule, err := scheduleConfig.Schedule()
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return NewTimetable(schedules, location, clock), nil
+}
+
+// line finds a top-level block, or the i'th entry of a top-level list.
+func (config Config) line(key string, i int) int {
+	if i < 0 {
+		if line, ok := config.positions.blocks[key]; ok {
+			return line
+		}
+		return 1
+	}
+
+	if lines := config.positions.items[key]; i < len(lines) {
+		return lines[i]
+	}
+	return 1
+}
+
+// Menu builds the products described by the configuration.
+func (config Config) Menu() (*Menu, error) {
+	return config.menu(0, nil, RealClock())
+}
+
+// menu builds the menu of the market at locationID on clock, logging its
+// clock ticks to log.
+func (config Config) menu(locationID int, log *EventLog, clock Clock) (*Menu, error) {
+	history := NewHistory(config.History.Size, clock)
+	if config.History.Path != "" {
+		var err error
+		history, err = OpenHistory(config.History.Size, config.History.Path, clock)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	timetable, err := config.timetable(clock)
+	if err != nil {
+		return nil, err
+	}
+
+	menu := &Menu{
+		LocationID: locationID,
+		Events:     NewBroker(),
+		History:    history,
+		Bills:      NewBillLedger(),
+		Crash:      &CrashState{},
+		Demand:     NewDemand(config.CrashRules),
+		Compliance: &Compliance{},
+		Log:        log,
+		Clock:      clock,
+		Scheduler:  NewScheduler(clock),
+		Timetable:  timetable,
+		Money:      config.Market.Money(),
+	}
+	for _, product := range config.Products {
+		menu.Items = append(menu.Items, config.NewProduct(product, menu.ProductOptions()...))
+	}
+	return menu, nil
+}
+
+func (config Config) NewProduct(product ProductConfig, options ...ProductOption) *Product {
+	settings := config.settings(product)
+
+	options = append([]ProductOption{
+		WithRatios(settings.LowRatio, settings.CrashRatio),
+		WithClockPeriod(settings.ClockPeriod),
+		WithStrategy(settings.Strategy.Strategy(settings.PriceIncrement)),
+		WithRefundMode(settings.RefundMode),
+		WithCrashTiming(settings.CrashWindow, settings.CrashCooldown, settings.CrashHold),
+		WithCategory(product.Category),
+		WithCost(product.CostPrice, settings.MinMargin),
+		WithLegalFloor(settings.Jurisdiction, config.MinimumUnitPrices[settings.Jurisdiction], product.ABV, product.Volume),
+		WithPriceSets(config.priceSets(product)),
+		WithRounding(settings.Rounding.Rounding()),
+	}, options...)
+
+	return NewProduct(product.ID, product.Name, product.BasePrice, options...)
+}
+
+func (strategy StrategyConfig) Strategy(increment float64) PricingStrategy {
+	switch strategy.Type {
+	case StrategyLinear:
+		return LinearStrategy{Step: strategy.Step}
+	case StrategyExponential:
+		return ExponentialDecayStrategy{Increment: increment, Decay: strategy.Decay}
+	case StrategyElasticity:
+		return DemandElasticityStrategy{Increment: increment, Elasticity: strategy.Elasticity}
+	default:
+		return StepStrategy{Increment: increment}
+	}
+}
+
+type configPositions struct {
+	blocks map[string]int
+	items  map[string][]int
+}
+
+// configLines finds the line each top-level block starts on and the line of
+// each entry in top-level lists. yaml.v2 doesn't expose node positions, so
+// validation errors would otherwise have nothing to point at.
+func configLines(data []byte) configPositions {
+	positions := configPositions{
+		blocks: map[string]int{},
+		items:  map[string][]int{},
+	}
+
+	block := ""
+	itemIndent := -1
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(text) - len(trimmed)
+
+		if indent == 0 && !strings.HasPrefix(trimmed, "-") {
+			block = strings.TrimSpace(strings.SplitN(trimmed, ":", 2)[0])
+			positions.blocks[block] = line
+			itemIndent = -1
+			continue
+		}
+
+		if !strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		if itemIndent == -1 {
+			itemIndent = indent
+		}
+		if indent == itemIndent {
+			positions.items[block] = append(positions.items[block], line)
+		}
+	}
+
+	return positions
+}
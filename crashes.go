@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A crash is of a single product that went past its crash price, one of
+// many products crashed together by a rule covering the market or a category,
+// or one fired by bar staff.
+const CrashProduct = "product"
+const CrashMarket = "market"
+const CrashCategory = "category"
+const CrashManual = "manual"
+
+// maxCrashHistory bounds how many past crashes a market keeps.
+const maxCrashHistory = 1000
+
+// Crash is a product's price crashing. It stays active, and on the displays,
+// until it ends.
+type Crash struct {
+	ID          int       `json:"id"`
+	Type        string    `json:"type"`
+	Category    string    `json:"category,omitempty"`
+	ProductID   int       `json:"productId"`
+	Time        time.Time `json:"time"`
+	Ends        time.Time `json:"ends"`
+	PriceBefore int       `json:"priceBefore"`
+	PriceAfter  int       `json:"priceAfter"`
+}
+
+// CrashState holds a market's active crashes, any number of which can be
+// running at once, and the crashes it has had.
+type CrashState struct {
+	lock    sync.RWMutex
+	lastID  int
+	active  []Crash
+	history []Crash
+}
+
+// Start numbers a crash and makes it active.
+func (crashes *CrashState) Start(crash Crash) Crash {
+	if crashes == nil {
+		return crash
+	}
+
+	crashes.lock.Lock()
+	defer crashes.lock.Unlock()
+
+	crashes.lastID++
+	crash.ID = crashes.lastID
+
+	crashes.active = append(crashes.active, crash)
+	crashes.history = append(crashes.history, crash)
+	if len(crashes.history) > maxCrashHistory {
+		crashes.history = crashes.history[len(crashes.history)-maxCrashHistory:]
+	}
+
+	return crash
+}
+
+// End takes a crash off the displays. Other crashes, even of the same
+// product, stay active.
+func (crashes *CrashState) End(crashID int) {
+	if crashes == nil {
+		return
+	}
+
+	crashes.lock.Lock()
+	defer crashes.lock.Unlock()
+
+	for i, crash := range crashes.active {
+		if crash.ID == crashID {
+			crashes.active = append(crashes.active[:i:i], crashes.active[i+1:]...)
+			return
+		}
+	}
+}
+
+// EndAfter ends a crash once expired fires.
+func (crashes *CrashState) EndAfter(crashID int, expired <-chan time.Time) {
+	go func() {
+		<-expired
+		crashes.End(crashID)
+	}()
+}
+
+// Active lists the crashes on the displays, oldest first.
+func (crashes *CrashState) Active() []Crash {
+	crashes.lock.RLock()
+	defer crashes.lock.RUnlock()
+
+	return append([]Crash{}, crashes.active...)
+}
+
+// History lists past and active crashes, oldest first.
+func (crashes *CrashState) History() []Crash {
+	crashes.lock.RLock()
+	defer crashes.lock.RUnlock()
+
+	return append([]Crash{}, crashes.history...)
+}
+
+// Latest is the most recent active crash, if any.
+func (crashes *CrashState) Latest() *Crash {
+	crashes.lock.RLock()
+	defer crashes.lock.RUnlock()
+
+	if len(crashes.active) == 0 {
+		return nil
+	}
+	crash := crashes.active[len(crashes.active)-1]
+	return &crash
+}
+
+// Restore brings back the crashes in a snapshot. Crashes started since carry
+// on numbering from the last of them.
+func (crashes *CrashState) Restore(active, history []Crash) {
+	crashes.lock.Lock()
+	defer crashes.lock.Unlock()
+
+	crashes.active = append([]Crash{}, active...)
+	crashes.history = append([]Crash{}, history...)
+	for _, crash := range history {
+		if crash.ID > crashes.lastID {
+			crashes.lastID = crash.ID
+		}
+	}
+}
+
+type crashResponse struct {
+	ID               int       `json:"id"`
+	Type             string    `json:"type"`
+	Category         string    `json:"category,omitempty"`
+	ProductID        int       `json:"productId"`
+	Time             time.Time `json:"time"`
+	Ends             time.Time `json:"ends"`
+	PriceBefore      string    `json:"priceBefore"`
+	PriceAfter       string    `json:"priceAfter"`
+	PriceBeforeMinor int       `json:"priceBeforeMinor"`
+	PriceAfterMinor  int       `json:"priceAfterMinor"`
+}
+
+type crashesResponse struct {
+	Crashes []crashResponse `json:"crashes"`
+}
+
+func newCrashResp(crash Crash, money Money) crashResponse {
+	return crashResponse{
+		ID:               crash.ID,
+		Type:             crash.Type,
+		Category:         crash.Category,
+		ProductID:        crash.ProductID,
+		Time:             crash.Time,
+		Ends:             crash.Ends,
+		PriceBefore:      money.Format(crash.PriceBefore),
+		PriceAfter:       money.Format(crash.PriceAfter),
+		PriceBeforeMinor: crash.PriceBefore,
+		PriceAfterMinor:  crash.PriceAfter,
+	}
+}
+
+func writeCrashes(w http.ResponseWriter, crashes []Crash, money Money) {
+	response := crashesResponse{Crashes: []crashResponse{}}
+	for _, crash := range crashes {
+		response.Crashes = append(response.Crashes, newCrashResp(crash, money))
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func serveCrashes(w http.ResponseWriter, r *http.Request, market *Market) {
+	writeCrashes(w, market.Menu.Crash.History(), market.Menu.Money)
+}
+
+func serveActiveCrashes(w http.ResponseWriter, r *http.Request, market *Market) {
+	writeCrashes(w, market.Menu.Crash.Active(), market.Menu.Money)
+}
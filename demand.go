@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CrashRule crashes every product in scope together once they have sold
+// Sales times within Window. A rule without a category covers the whole
+// market.
+type CrashRule struct {
+	Category string        `yaml:"category"`
+	Sales    int           `yaml:"sales"`
+	Window   time.Duration `yaml:"window"`
+}
+
+// Scope is the crash type a rule's crashes have.
+func (rule CrashRule) Scope() string {
+	if rule.Category == "" {
+		return CrashMarket
+	}
+	return CrashCategory
+}
+
+func (rule CrashRule) covers(category string) bool {
+	return rule.Category == "" || rule.Category == category
+}
+
+// Demand counts sales against a market's crash rules.
+type Demand struct {
+	lock  sync.Mutex
+	rules []*demandRule
+}
+
+type demandRule struct {
+	rule  CrashRule
+	sales []time.Time
+}
+
+func NewDemand(rules []CrashRule) *Demand {
+	demand := &Demand{}
+	for _, rule := range rules {
+		demand.rules = append(demand.rules, &demandRule{rule: rule})
+	}
+	return demand
+}
+
+// Sale counts count sales of a product in category at now, and returns the
+// rules they tipped over. A rule starts counting again once it has fired.
+func (demand *Demand) Sale(category string, count int, now time.Time) []CrashRule {
+	if demand == nil {
+		return nil
+	}
+
+	demand.lock.Lock()
+	defer demand.lock.Unlock()
+
+	var fired []CrashRule
+	for _, rule := range demand.rules {
+		if !rule.rule.covers(category) {
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			rule.sales = append(rule.sales, now)
+		}
+
+		since := now.Add(-rule.rule.Window)
+		for len(rule.sales) > 0 && !rule.sales[0].After(since) {
+			rule.sales = rule.sales[1:]
+		}
+
+		if len(rule.sales) >= rule.rule.Sales {
+			rule.sales = nil
+			fired = append(fired, rule.rule)
+		}
+	}
+
+	return fired
+}
+
+// CrashAll crashes every product on sale that rule covers.
+func (menu *Menu) CrashAll(rule CrashRule) {
+	for _, product := range menu.Products() {
+		if rule.covers(product.Category) {
+			product.ForceCrash(rule.Scope(), rule.Category)
+		}
+	}
+}
+
+// Reset forgets the sales counted so far.
+func (demand *Demand) Reset() {
+	if demand == nil {
+		return
+	}
+
+	demand.lock.Lock()
+	defer demand.lock.Unlock()
+
+	for _, rule := range demand.rules {
+		rule.sales = nil
+	}
+}
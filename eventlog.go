@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const LogBill = "bill"
+const LogTick = "tick"
+const LogAdmin = "admin"
+const LogSchedule = "schedule"
+const LogRestore = "restore"
+
+// LogEntry is one input to the market: a bill event accepted from the POS, a
+// clock tick of one product, an action bar staff took on one product or the
+// menu, the market moving onto a schedule, where no schedule means none is
+// active, or the state the market started from after a restart. Products
+// created or updated by staff carry what was set on them.
+type LogEntry struct {
+	Time       time.Time            `json:"time"`
+	Type       string               `json:"type"`
+	LocationID int                  `json:"locationId"`
+	ProductID  int                  `json:"productId,omitempty"`
+	Event      *billEvent           `json:"event,omitempty"`
+	Action     string               `json:"action,omitempty"`
+	Price      int                  `json:"price,omitempty"`
+	Product    *adminProductRequest `json:"product,omitempty"`
+	Schedule   string               `json:"schedule,omitempty"`
+	Snapshot   *MarketSnapshot      `json:"snapshot,omitempty"`
+}
+
+// EventLog appends every input to the market to a file as a JSON line, in
+// the order they were applied, so the market can be rebuilt by replaying
+// them. Until it is opened, inputs are applied without being logged.
+type EventLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func NewEventLog() *EventLog {
+	return &EventLog{}
+}
+
+// Open starts appending to the file at path.
+func (eventLog *EventLog) Open(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	eventLog.lock.Lock()
+	defer eventLog.lock.Unlock()
+
+	eventLog.file = file
+	return nil
+}
+
+// Record logs entry and applies it. Entries are applied one at a time so the
+// log holds them in the order they changed prices.
+func (eventLog *EventLog) Record(entry LogEntry, apply func()) {
+	if eventLog == nil {
+		apply()
+		return
+	}
+
+	eventLog.lock.Lock()
+	defer eventLog.lock.Unlock()
+
+	if eventLog.file != nil {
+		entry.Time = time.Now()
+		data, err := json.Marshal(entry)
+		if err == nil {
+			eventLog.file.Write(append(data, '\n'))
+		}
+	}
+
+	apply()
+}
+
+func (eventLog *EventLog) Close() error {
+	if eventLog == nil {
+		return nil
+	}
+
+	eventLog.lock.Lock()
+	defer eventLog.lock.Unlock()
+
+	if eventLog.file == nil {
+		return nil
+	}
+	err := eventLog.file.Close()
+	eventLog.file = nil
+	return err
+}
+
+// Replay feeds the entries in r through the markets' pricing, stopping at the
+// first entry after until unless until is zero. Markets on a ReplayClock see
+// each entry happen at the time it was logged. If trace isn't nil, the prices
+// each entry moved to are written to it.
+func Replay(markets *Markets, r io.Reader, until time.Time, trace io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	clock, _ := markets.Clock.(*ReplayClock)
+
+	for line := 1; scanner.Scan(); line++ {
+		var entry LogEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if !until.IsZero() && entry.Time.After(until) {
+			break
+		}
+		if clock != nil {
+			clock.Set(entry.Time)
+		}
+
+		var moved []*Product
+		switch entry.Type {
+		case LogBill:
+			if entry.Event == nil {
+				return fmt.Errorf("line %d: bill entry has no event", line)
+			}
+			err = entry.Event.Bill.validate()
+			if err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			market := markets.For(entry.Event.Bill.LocationID)
+			if market == nil {
+				continue
+			}
+			moved = market.ApplyBill(*entry.Event)
+		case LogTick:
+			market := markets.Location(entry.LocationID)
+			if market == nil {
+				continue
+			}
+			product, err := market.Menu.Product(entry.ProductID)
+			if err != nil {
+				continue
+			}
+			product.DecrPrice()
+			moved = []*Product{product}
+		case LogAdmin:
+			market := markets.Location(entry.LocationID)
+			if market == nil {
+				continue
+			}
+			product, err := market.ApplyAdmin(entry)
+			if err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			if product != nil {
+				moved = []*Product{product}
+			}
+		case LogSchedule:
+			market := markets.Location(entry.LocationID)
+			if market == nil {
+				continue
+			}
+			schedule, ok := market.Menu.Timetable.Lookup(entry.Schedule)
+			if !ok {
+				continue
+			}
+			market.Menu.ApplySchedule(schedule)
+			moved = market.Menu.Products()
+		case LogRestore:
+			if entry.Snapshot == nil {
+				return fmt.Errorf("line %d: restore entry has no snapshot", line)
+			}
+			market := markets.Location(entry.LocationID)
+			if market == nil {
+				continue
+			}
+			moved = market.Restart(*entry.Snapshot, entry.Time)
+		default:
+			return fmt.Errorf("line %d: unknown entry type %q", line, entry.Type)
+		}
+
+		if trace != nil {
+			for _, product := range moved {
+				fmt.Fprintf(trace, "%s %s location %d: %s %s\n",
+					entry.Time.Format(time.RFC3339), entry.Type, entry.LocationID, product.Name, product.money.Format(product.Current()))
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// LogStart is the time of the first entry in the log at path, or now if
+// there isn't one.
+func LogStart(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return time.Now(), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	if !scanner.Scan() {
+		return time.Now(), scanner.Err()
+	}
+
+	var entry LogEntry
+	err = json.Unmarshal(scanner.Bytes(), &entry)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: line 1: %s", path, err)
+	}
+	return entry.Time, nil
+}
+
+// ReplayFile replays the log at path. A log that doesn't exist yet has
+// nothing to replay.
+func ReplayFile(markets *Markets, path string, until time.Time, trace io.Writer) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = Replay(markets, file, until, trace)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
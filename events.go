@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const EventPrice = "price"
+const EventCrash = "crash"
+const EventAdded = "added"
+const EventRetired = "retired"
+
+// BrokerBacklog is how many recent events a broker keeps for clients that
+// reconnect and ask to catch up.
+const BrokerBacklog = 1000
+
+// subscriberBuffer is how far a subscriber may fall behind before it is
+// dropped rather than holding up the market.
+const subscriberBuffer = 64
+
+type MarketEvent struct {
+	Seq       uint64         `json:"seq"`
+	Type      string         `json:"type"`
+	Time      time.Time      `json:"time"`
+	ProductID int            `json:"productId"`
+	Price     *priceResponse `json:"price,omitempty"`
+	Crash     *crashResponse `json:"crash,omitempty"`
+}
+
+// Broker numbers market events and fans them out to subscribers. Publishing
+// never blocks: a subscriber that can't keep up is dropped and has to
+// resubscribe from the last event it saw.
+type Broker struct {
+	lock        sync.Mutex
+	seq         uint64
+	backlog     []MarketEvent
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+type Subscription struct {
+	C      <-chan MarketEvent
+	c      chan MarketEvent
+	broker *Broker
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+func (broker *Broker) Publish(event MarketEvent) MarketEvent {
+	if broker == nil {
+		return event
+	}
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	broker.seq++
+	event.Seq = broker.seq
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	broker.backlog = append(broker.backlog, event)
+	if len(broker.backlog) > BrokerBacklog {
+		broker.backlog = broker.backlog[len(broker.backlog)-BrokerBacklog:]
+	}
+
+	for subscription := range broker.subscribers {
+		select {
+		case subscription.c <- event:
+		default:
+			broker.drop(subscription)
+		}
+	}
+
+	return event
+}
+
+// Subscribe returns the retained events after lastSeq along with a
+// subscription for everything published from then on, so nothing is missed
+// or seen twice in between.
+func (broker *Broker) Subscribe(lastSeq uint64) (*Subscription, []MarketEvent) {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	var missed []MarketEvent
+	for _, event := range broker.backlog {
+		if event.Seq > lastSeq {
+			missed = append(missed, event)
+		}
+	}
+
+	c := make(chan MarketEvent, subscriberBuffer)
+	subscription := &Subscription{C: c, c: c, broker: broker}
+	broker.subscribers[subscription] = struct{}{}
+	if broker.closed {
+		broker.drop(subscription)
+	}
+
+	return subscription, missed
+}
+
+// Close ends every subscription, and any made from now on, so streams
+// finish when the service shuts down.
+func (broker *Broker) Close() {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	broker.closed = true
+	for subscription := range broker.subscribers {
+		broker.drop(subscription)
+	}
+}
+
+// Closed reports whether the broker has been closed.
+func (broker *Broker) Closed() bool {
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	return broker.closed
+}
+
+func (subscription *Subscription) Close() {
+	broker := subscription.broker
+
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+
+	broker.drop(subscription)
+}
+
+func (broker *Broker) drop(subscription *Subscription) {
+	if _, ok := broker.subscribers[subscription]; !ok {
+		return
+	}
+
+	delete(broker.subscribers, subscription)
+	close(subscription.c)
+}
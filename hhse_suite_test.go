@@ -8,12 +8,15 @@ import (
 	"github.com/onsi/gomega/gexec"
 	"os/exec"
 	"fmt"
+	"time"
+	"net/http"
 )
 
 var host string
 var port int
 
 const projectPath = "github.com/flypay/hhse"
+const adminToken = "secret"
 
 func TestHhse(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -32,6 +35,7 @@ func TestHhse(t *testing.T) {
 		command := exec.Command(packagePath)
 		command.Env = []string{
 			fmt.Sprintf("PORT=%d", port),
+			fmt.Sprintf("HHSE_ADMIN_TOKEN=%s", adminToken),
 		}
 
 		service, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
@@ -46,7 +50,10 @@ func TestHhse(t *testing.T) {
 		gexec.CleanupBuildArtifacts()
 
 		if service != nil {
-			service.Terminate().Wait()
+			// Connections the client dialed but never used would hold up the
+			// server's shutdown.
+			http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+			Eventually(service.Terminate(), 5*time.Second).Should(gexec.Exit(0), "service should shut down cleanly when terminated")
 		}
 	})
 
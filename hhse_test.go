@@ -8,6 +8,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"time"
+	"os"
+	"path/filepath"
+	"encoding/json"
+	"golang.org/x/text/language"
 )
 
 var _ = Describe("Hhse", func() {
@@ -72,17 +81,33 @@ var _ = Describe("Hhse", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			Expect(string(body)).To(MatchJSON(`{
+				"currency": "GBP",
 				"prices": [
-					{ "id": 1, "low": "£1.08", "high": "£1.08", "current": "£1.08", "trend": "" },
-					{ "id": 2, "low": "£0.96", "high": "£0.96", "current": "£0.96", "trend": "" },
-					{ "id": 3, "low": "£0.84", "high": "£0.84", "current": "£0.84", "trend": "" },
-					{ "id": 4, "low": "£0.96", "high": "£0.96", "current": "£0.96", "trend": "" },
-					{ "id": 5, "low": "£0.96", "high": "£0.96", "current": "£0.96", "trend": "" }
+					{ "id": 1, "low": "£1.08", "high": "£1.08", "current": "£1.08", "lowMinor": 108, "highMinor": 108, "currentMinor": 108, "trend": "" },
+					{ "id": 2, "low": "£0.96", "high": "£0.96", "current": "£0.96", "lowMinor": 96, "highMinor": 96, "currentMinor": 96, "trend": "" },
+					{ "id": 3, "low": "£0.84", "high": "£0.84", "current": "£0.84", "lowMinor": 84, "highMinor": 84, "currentMinor": 84, "trend": "" },
+					{ "id": 4, "low": "£0.96", "high": "£0.96", "current": "£0.96", "lowMinor": 96, "highMinor": 96, "currentMinor": 96, "trend": "" },
+					{ "id": 5, "low": "£0.96", "high": "£0.96", "current": "£0.96", "lowMinor": 96, "highMinor": 96, "currentMinor": 96, "trend": "" }
 				],
 				"crash": null
 			}`))
 		})
 
+		It("should write prices in the language asked for", func() {
+			req, err := http.NewRequest(http.MethodGet, endpoint("/prices"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Accept-Language", "de-DE,de;q=0.9,en;q=0.5")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`"currency":"GBP"`))
+			Expect(string(body)).To(ContainSubstring("\"current\":\"1,08\u00a0£\",\"lowMinor\":108"))
+		})
+
 		Context("when a bill event indicates a sale", func() {
 			BeforeEach(func() {
 				resp, err := http.Post(endpoint("/events"), "application/json", strings.NewReader(`{
@@ -156,12 +181,13 @@ var _ = Describe("Hhse", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(string(body)).To(MatchJSON(`{
+					"currency": "GBP",
 					"prices": [
-						{ "id": 1, "low": "£1.08", "high": "£1.18", "current": "£1.18", "trend": "up" },
-						{ "id": 2, "low": "£0.96", "high": "£0.96", "current": "£0.96", "trend": "" },
-						{ "id": 3, "low": "£0.84", "high": "£0.84", "current": "£0.84", "trend": "" },
-						{ "id": 4, "low": "£0.96", "high": "£0.96", "current": "£0.96", "trend": "" },
-						{ "id": 5, "low": "£0.96", "high": "£0.96", "current": "£0.96", "trend": "" }
+						{ "id": 1, "low": "£1.08", "high": "£1.18", "current": "£1.18", "lowMinor": 108, "highMinor": 118, "currentMinor": 118, "trend": "up" },
+						{ "id": 2, "low": "£0.96", "high": "£0.96", "current": "£0.96", "lowMinor": 96, "highMinor": 96, "currentMinor": 96, "trend": "" },
+						{ "id": 3, "low": "£0.84", "high": "£0.84", "current": "£0.84", "lowMinor": 84, "highMinor": 84, "currentMinor": 84, "trend": "" },
+						{ "id": 4, "low": "£0.96", "high": "£0.96", "current": "£0.96", "lowMinor": 96, "highMinor": 96, "currentMinor": 96, "trend": "" },
+						{ "id": 5, "low": "£0.96", "high": "£0.96", "current": "£0.96", "lowMinor": 96, "highMinor": 96, "currentMinor": 96, "trend": "" }
 					],
 					"crash": null
 				}`))
@@ -239,9 +265,1677 @@ var _ = Describe("Hhse", func() {
 					Expect(product.High()).To(Equal(24))
 				})
 			})
+
+			Describe("ReversePrice", func() {
+				It("should undo the last sale", func() {
+					product.IncrPrice()
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(22))
+
+					product.ReversePrice()
+					Expect(product.Current()).To(Equal(21))
+					Expect(product.Trend).To(Equal("down"))
+
+					product.ReversePrice()
+					product.ReversePrice()
+					Expect(product.Current()).To(Equal(20))
+				})
+
+				It("should move down a tick when configured to", func() {
+					product = NewProduct(1, "Beer", 1000, WithRefundMode(RefundTick))
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(208))
+
+					product.ReversePrice()
+					Expect(product.Current()).To(Equal(200))
+				})
+			})
+
+			Describe("SetPrice", func() {
+				It("should move the price within the product's range", func() {
+					product.IncrPrice()
+					Expect(product.SetPrice(60)).To(Succeed())
+					Expect(product.Current()).To(Equal(60))
+					Expect(product.High()).To(Equal(60))
+					Expect(product.Trend).To(Equal("up"))
+
+					product.ReversePrice()
+					Expect(product.Current()).To(Equal(60))
+
+					Expect(product.SetPrice(81)).To(MatchError("price must be between £0.20 and £0.80"))
+					Expect(product.SetPrice(19)).To(HaveOccurred())
+				})
+			})
+
+			Describe("Freeze", func() {
+				It("should hold the price until unfrozen", func() {
+					product.IncrPrice()
+					product.Freeze()
+
+					product.IncrPrice()
+					product.DecrPrice()
+					product.ReversePrice()
+					_, err := product.ForceCrash(CrashMarket, "")
+					Expect(err).To(MatchError("product 1 is frozen"))
+					Expect(product.Current()).To(Equal(21))
+
+					product.Unfreeze()
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(22))
+				})
+			})
+
+			Describe("with a cost price", func() {
+				BeforeEach(func() {
+					product = NewProduct(1, "Beer", 100, WithCost(40, 5))
+				})
+
+				It("should not go below cost plus the margin", func() {
+					Expect(product.Current()).To(Equal(45))
+
+					product.IncrPrice()
+					product.DecrPrice()
+					product.DecrPrice()
+					Expect(product.Current()).To(Equal(45))
+
+					product.IncrPrice()
+					product.ForceCrash(CrashManual, "")
+					Expect(product.Current()).To(Equal(45))
+
+					Expect(product.SetBasePrice(50)).To(MatchError("floor of £0.45 is above the crash price of £0.40"))
+					Expect(product.SetBasePrice(80)).To(Succeed())
+					Expect(product.Current()).To(Equal(45))
+				})
+			})
+
+			Describe("with a minimum unit price", func() {
+				var compliance *Compliance
+
+				BeforeEach(func() {
+					compliance = &Compliance{}
+					product = NewProduct(1, "Pint", 500, WithLegalFloor("scotland", 65, 5.0, 568), WithCompliance(compliance))
+				})
+
+				It("should clamp every strategy to the legal floor", func() {
+					Expect(product.Current()).To(Equal(185))
+
+					product.IncrPrice()
+					product.DecrPrice()
+					product.DecrPrice()
+					Expect(product.Current()).To(Equal(185))
+
+					product.IncrPrice()
+					product.ForceCrash(CrashManual, "")
+					Expect(product.Current()).To(Equal(185))
+
+					clamps := compliance.Clamps()
+					Expect(clamps).To(HaveLen(2))
+					Expect(clamps[0].Cause).To(Equal("open"))
+					Expect(clamps[1].Cause).To(Equal("crash"))
+					Expect(clamps[1].Price).To(Equal(100))
+					Expect(clamps[1].Floor).To(Equal(185))
+					Expect(clamps[1].Reason).To(Equal("minimum unit price in scotland: 2.84 units at 65p a unit"))
+				})
+			})
+
+			Describe("with a pricing strategy", func() {
+				BeforeEach(func() {
+					product = NewProduct(1, "Beer", 100, WithStrategy(LinearStrategy{Step: 5}))
+				})
+
+				It("should move the price using the strategy", func() {
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(25))
+
+					product.DecrPrice()
+					product.DecrPrice()
+					Expect(product.Current()).To(Equal(20))
+					Expect(product.Trend).To(Equal(""))
+				})
+			})
+
+			Describe("with rounding", func() {
+				BeforeEach(func() {
+					product = NewProduct(1, "Beer", 500, WithStrategy(LinearStrategy{Step: 3}), WithRounding(Rounding{Step: 10}))
+				})
+
+				It("should show rounded prices and keep the steps between them", func() {
+					Expect(product.Current()).To(Equal(100))
+
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(100))
+
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(110))
+					Expect(product.High()).To(Equal(110))
+					Expect(product.Low()).To(Equal(100))
+				})
+
+				It("should never round below the floor", func() {
+					product = NewProduct(1, "Beer", 500, WithRounding(Rounding{Step: 10, Offset: -1}))
+					Expect(product.Current()).To(Equal(109))
+				})
+			})
+
+			Describe("on a manual clock", func() {
+				var clock *ManualClock
+
+				BeforeEach(func() {
+					clock = NewManualClock(time.Date(2017, 6, 15, 22, 0, 0, 0, time.UTC))
+				})
+
+				Describe("and a scheduler", func() {
+					var scheduler *Scheduler
+					var history *History
+
+					lastCause := func() string {
+						points := history.Between(1, time.Time{}, time.Time{})
+						return points[len(points)-1].Cause
+					}
+
+					BeforeEach(func() {
+						scheduler = NewScheduler(clock)
+						scheduler.Start()
+						history = NewHistory(10, clock)
+						product = NewProduct(1, "Beer", 100, WithClock(clock), WithHistory(history), WithScheduler(scheduler))
+						product.IncrPrice()
+						product.IncrPrice()
+						Eventually(clock.Timers).Should(Equal(1))
+					})
+
+					AfterEach(func() {
+						scheduler.Stop()
+					})
+
+					It("should decay once a clock period passes without a sale", func() {
+						clock.Advance(59 * time.Second)
+						Consistently(lastCause).Should(Equal("sale"))
+
+						clock.Advance(time.Second)
+						Eventually(lastCause).Should(Equal("tick"))
+					})
+
+					It("should not decay while paused", func() {
+						scheduler.Pause()
+						Eventually(clock.Timers).Should(Equal(0))
+						clock.Advance(time.Hour)
+						Consistently(lastCause).Should(Equal("sale"))
+
+						scheduler.Resume()
+						Eventually(clock.Timers).Should(Equal(1))
+						clock.Advance(time.Minute)
+						Eventually(lastCause).Should(Equal("tick"))
+					})
+
+					It("should stop ticking retired products", func() {
+						product.Stop()
+						Expect(scheduler.Len()).To(Equal(0))
+
+						clock.Advance(time.Hour)
+						Consistently(lastCause).Should(Equal("sale"))
+					})
+				})
+
+				It("should end a crash once the crash window has passed", func() {
+					crashes := &CrashState{}
+					product = NewProduct(1, "Beer", 100, WithClock(clock), WithCrash(crashes))
+					for crashes.Latest() == nil {
+						product.IncrPrice()
+					}
+
+					active := crashes.Active()
+					Expect(active).To(HaveLen(1))
+					Expect(active[0]).To(Equal(Crash{ID: 1, Type: CrashProduct, ProductID: 1, Time: clock.Now(), Ends: clock.Now().Add(CrashWindow), PriceBefore: 80, PriceAfter: 20}))
+
+					clock.Advance(time.Second)
+					Consistently(crashes.Latest).ShouldNot(BeNil())
+
+					clock.Advance(time.Second)
+					Eventually(crashes.Active).Should(BeEmpty())
+					Expect(crashes.History()).To(HaveLen(1))
+				})
+
+				It("should not climb during the cooldown after a crash", func() {
+					crashes := &CrashState{}
+					product = NewProduct(1, "Beer", 100, WithClock(clock), WithCrash(crashes),
+						WithCrashTiming(time.Second, time.Minute, 0))
+					for crashes.Latest() == nil {
+						product.IncrPrice()
+					}
+					clock.Advance(time.Second)
+					Eventually(crashes.Active).Should(BeEmpty())
+
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(20))
+
+					clock.Advance(59 * time.Second)
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(21))
+				})
+
+				It("should hold at the floor for a number of ticks after a crash", func() {
+					crashes := &CrashState{}
+					product = NewProduct(1, "Beer", 100, WithClock(clock), WithCrash(crashes),
+						WithStrategy(LinearStrategy{Step: 10}), WithCrashTiming(CrashWindow, 0, 2))
+					for crashes.Latest() == nil {
+						product.IncrPrice()
+					}
+					Expect(product.Current()).To(Equal(20))
+
+					product.DecrPrice()
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(20))
+
+					product.DecrPrice()
+					product.IncrPrice()
+					Expect(product.Current()).To(Equal(30))
+				})
+
+				It("should keep crashes of different products apart", func() {
+					crashes := &CrashState{}
+					beer := NewProduct(1, "Beer", 100, WithClock(clock), WithCrash(crashes))
+					cider := NewProduct(2, "Cider", 100, WithClock(clock), WithCrash(crashes))
+					for len(crashes.Active()) == 0 {
+						beer.IncrPrice()
+					}
+					clock.Advance(time.Second)
+					for len(crashes.Active()) == 1 {
+						cider.IncrPrice()
+					}
+					Expect(crashes.Latest().ProductID).To(Equal(2))
+
+					clock.Advance(time.Second)
+					Eventually(crashes.Active).Should(HaveLen(1))
+					Expect(crashes.Active()[0].ProductID).To(Equal(2))
+
+					clock.Advance(time.Second)
+					Eventually(crashes.Active).Should(BeEmpty())
+				})
+			})
 		})
 	})
-})
+
+	Describe("Config", func() {
+		It("should build the menu from YAML", func() {
+			config, err := ParseConfig([]byte(`
+market:
+  low_ratio: 0.5
+products:
+  - id: 7
+    name: Guest Ale
+    base_price: 400
+  - id: 8
+    name: Cider
+    base_price: 300
+    low_ratio: 0.25
+`))
+			Expect(err).NotTo(HaveOccurred())
+
+			menu, err := config.Menu()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(menu.Items).To(HaveLen(2))
+			Expect(menu.Items[0].Name).To(Equal("Guest Ale"))
+			Expect(menu.Items[0].Current()).To(Equal(200))
+			Expect(menu.Items[1].Current()).To(Equal(75))
+		})
+
+		It("should point at the line of an invalid product", func() {
+			_, err := ParseConfig([]byte(`
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+  - id: 1
+    name: Carlsberg
+    base_price: 480
+`))
+			Expect(err).To(MatchError("line 6: product 2: id 1 is used by another product"))
+		})
+
+		It("should reject unknown settings", func() {
+			_, err := ParseConfig([]byte(`
+products:
+  - id: 1
+    name: Stella
+    price: 540
+`))
+			Expect(err).To(MatchError(ContainSubstring("line 3")))
+		})
+
+		It("should reject a crash window that isn't positive", func() {
+			_, err := ParseConfig([]byte(`
+market:
+  crash_window: 0s
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+`))
+			Expect(err).To(MatchError("line 2: market: crash_window must be greater than 0"))
+		})
+
+		It("should keep prices above cost plus the minimum margin", func() {
+			config, err := ParseConfig([]byte(`
+market:
+  min_margin: 50
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+    cost_price: 200
+  - id: 2
+    name: Carlsberg
+    base_price: 480
+`))
+			Expect(err).NotTo(HaveOccurred())
+
+			menu, err := config.Menu()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(menu.Items[0].Current()).To(Equal(250))
+			Expect(menu.Items[1].Current()).To(Equal(96))
+		})
+
+		It("should reject a floor above the crash price", func() {
+			_, err := ParseConfig([]byte(`
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+    cost_price: 400
+    min_margin: 40
+`))
+			Expect(err).To(MatchError("line 3: product 1: floor of £4.40 is above the crash price of £4.32"))
+		})
+
+		It("should only price by minimum unit prices it knows", func() {
+			_, err := ParseConfig([]byte(`
+minimum_unit_prices:
+  scotland: 65
+market:
+  jurisdiction: wales
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+`))
+			Expect(err).To(MatchError(`line 4: market: no minimum_unit_prices for jurisdiction "wales"`))
+
+			_, err = ParseConfig([]byte(`
+minimum_unit_prices:
+  scotland: 65
+market:
+  jurisdiction: scotland
+products:
+  - id: 1
+    name: Whisky
+    base_price: 540
+    abv: 40
+    volume_ml: 500
+`))
+			Expect(err).To(MatchError("line 7: product 1: floor of £13.00 is above the crash price of £4.32"))
+		})
+	})
+
+	Describe("Markets", func() {
+		It("should build a market for each location", func() {
+			config, err := ParseConfig([]byte(`
+market:
+  low_ratio: 0.5
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+locations:
+  - id: 123
+    name: The Crown
+    market:
+      low_ratio: 0.25
+    products:
+      - id: 1
+        name: Guest Ale
+        base_price: 400
+`))
+			Expect(err).NotTo(HaveOccurred())
+
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			crown := markets.For(123)
+			Expect(crown.Name).To(Equal("The Crown"))
+			product, err := crown.Menu.Product(1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(product.Name).To(Equal("Guest Ale"))
+			Expect(product.Current()).To(Equal(100))
+
+			Expect(markets.For(456)).To(Equal(markets.Default))
+			Expect(markets.All()).To(HaveLen(2))
+		})
+
+		It("should point at the line of an invalid location", func() {
+			_, err := ParseConfig([]byte(`
+locations:
+  - id: 123
+    products:
+      - id: 1
+        name: Stella
+        base_price: 540
+  - id: 124
+    products: []
+`))
+			Expect(err).To(MatchError("line 8: location 124: no products configured"))
+		})
+
+		It("should not serve locations that aren't configured", func() {
+			resp, err := http.Get(endpoint("/locations/999/prices"))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Demand", func() {
+		start := time.Date(2017, 6, 15, 22, 0, 0, 0, time.UTC)
+
+		It("should fire a rule once enough sales land inside its window", func() {
+			demand := NewDemand([]CrashRule{{Category: "lager", Sales: 3, Window: time.Minute}})
+
+			Expect(demand.Sale("lager", 2, start)).To(BeEmpty())
+			Expect(demand.Sale("cider", 5, start)).To(BeEmpty())
+			Expect(demand.Sale("lager", 1, start.Add(time.Minute))).To(BeEmpty())
+			Expect(demand.Sale("lager", 2, start.Add(90*time.Second))).To(HaveLen(1))
+			Expect(demand.Sale("lager", 1, start.Add(90*time.Second))).To(BeEmpty())
+		})
+
+		It("should crash every product a rule covers together", func() {
+			config, err := ParseConfig([]byte(`
+products:
+  - id: 1
+    name: Stella
+    category: lager
+    base_price: 540
+  - id: 2
+    name: Carlsberg
+    category: lager
+    base_price: 480
+  - id: 3
+    name: Strongbow
+    category: cider
+    base_price: 480
+crash_rules:
+  - category: lager
+    sales: 10
+    window: 5m
+`))
+			Expect(err).NotTo(HaveOccurred())
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+			menu := markets.Default.Menu
+
+			for _, product := range menu.Products() {
+				product.IncrPrice()
+			}
+			menu.CrashAll(config.CrashRules[0])
+
+			crashes := menu.Crash.Active()
+			Expect(crashes).To(HaveLen(2))
+			for i, crash := range crashes {
+				Expect(crash.ProductID).To(Equal(i + 1))
+				Expect(crash.Type).To(Equal(CrashCategory))
+				Expect(crash.Category).To(Equal("lager"))
+				Expect(crash.PriceAfter).To(BeNumerically("<", crash.PriceBefore))
+			}
+		})
+
+		It("should reject rules for categories nothing is in", func() {
+			_, err := ParseConfig([]byte(`
+products:
+  - id: 1
+    name: Stella
+    category: lager
+    base_price: 540
+crash_rules:
+  - category: ale
+    sales: 10
+    window: 5m
+`))
+			Expect(err).To(MatchError(`line 8: crash rule 1: no products are in category "ale"`))
+		})
+
+		It("should check shared rules against each location's products", func() {
+			_, err := ParseConfig([]byte(`
+locations:
+  - id: 1
+    products:
+      - id: 1
+        name: Stella
+        category: lager
+        base_price: 540
+crash_rules:
+  - category: lager
+    sales: 10
+    window: 5m
+`))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = ParseConfig([]byte(`
+locations:
+  - id: 1
+    products:
+      - id: 1
+        name: Stella
+        category: lager
+        base_price: 540
+  - id: 2
+    products:
+      - id: 1
+        name: Strongbow
+        category: cider
+        base_price: 480
+crash_rules:
+  - category: lager
+    sales: 10
+    window: 5m
+`))
+			Expect(err).To(MatchError(`line 9: location 2: crash rule 1: no products are in category "lager"`))
+		})
+	})
+
+	Describe("Schedules", func() {
+		config, _ := ParseConfig([]byte(`
+timezone: Europe/London
+products:
+  - id: 1
+    name: Stella
+    base_price: 500
+schedules:
+  - name: Happy hour
+    days: [fri]
+    start: 17:00
+    end: 19:00
+    low_ratio: 0.5
+    crash_ratio: 0.9
+  - name: Late
+    days: [sat]
+    start: "22:00"
+    end: "02:00"
+`))
+		london, _ := time.LoadLocation("Europe/London")
+
+		It("should find the active schedule and when it next changes", func() {
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+			timetable := markets.Default.Menu.Timetable
+
+			active, next, ok := timetable.At(time.Date(2017, 6, 16, 18, 0, 0, 0, london))
+			Expect(active.Name).To(Equal("Happy hour"))
+			Expect(ok).To(BeTrue())
+			Expect(next).To(BeTemporally("==", time.Date(2017, 6, 16, 19, 0, 0, 0, london)))
+
+			active, next, _ = timetable.At(time.Date(2017, 6, 16, 19, 0, 0, 0, london))
+			Expect(active.Name).To(Equal(""))
+			Expect(active.Dynamic).To(BeFalse())
+			Expect(next).To(BeTemporally("==", time.Date(2017, 6, 17, 22, 0, 0, 0, london)))
+
+			active, next, _ = timetable.At(time.Date(2017, 6, 18, 1, 30, 0, 0, london))
+			Expect(active.Name).To(Equal("Late"))
+			Expect(next).To(BeTemporally("==", time.Date(2017, 6, 18, 2, 0, 0, 0, london)))
+		})
+
+		It("should fix prices outside schedules and swap ratios inside them", func() {
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+			menu := markets.Default.Menu
+			stella, _ := menu.Product(1)
+			happyHour, _ := menu.Timetable.Lookup("Happy hour")
+			late, _ := menu.Timetable.Lookup("Late")
+
+			menu.ApplySchedule(Schedule{})
+			Expect(stella.Current()).To(Equal(500))
+			stella.IncrPrice()
+			stella.DecrPrice()
+			Expect(stella.Current()).To(Equal(500))
+			Expect(stella.SetPrice(300)).To(MatchError("dynamic pricing is off"))
+
+			menu.ApplySchedule(happyHour)
+			Expect(stella.Current()).To(Equal(250))
+			Expect(stella.SetPrice(440)).To(Succeed())
+
+			menu.ApplySchedule(late)
+			Expect(stella.Current()).To(Equal(400))
+
+			added := config.NewProduct(ProductConfig{ID: 2, Name: "Carlsberg", BasePrice: 480}, menu.ProductOptions()...)
+			Expect(menu.Add(added)).To(Succeed())
+			menu.ApplySchedule(Schedule{})
+			Expect(added.Current()).To(Equal(480))
+
+			points := menu.History.Between(1, time.Time{}, time.Time{})
+			Expect(points[len(points)-1].Cause).To(Equal("schedule"))
+		})
+
+		It("should follow the schedules as the clock moves", func() {
+			schedule, _ := config.Schedules[0].Schedule()
+			clock := NewManualClock(time.Date(2017, 6, 16, 16, 59, 0, 0, london))
+			timetable := NewTimetable([]Schedule{schedule}, london, clock)
+
+			followed := make(chan string, 2)
+			timetable.Start(func(schedule Schedule) {
+				followed <- schedule.Name
+			})
+			defer timetable.Stop()
+
+			Eventually(followed).Should(Receive(Equal("")))
+			Eventually(clock.Timers).Should(Equal(1))
+			clock.Advance(time.Minute)
+			Eventually(followed).Should(Receive(Equal("Happy hour")))
+		})
+
+		It("should reject times it can't read", func() {
+			_, err := ParseConfig([]byte(`
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+schedules:
+  - name: Happy hour
+    start: 5pm
+    end: 7pm
+`))
+			Expect(err).To(MatchError(`line 7: schedule 1: start: "5pm" is not a time like 17:30`))
+		})
+	})
+
+	Describe("PricingStrategy", func() {
+		state := PriceState{BasePrice: 100, Current: 50, Min: 20, Max: 80}
+
+		It("should step by a percentage by default", func() {
+			strategy := DefaultStrategy()
+
+			Expect(strategy.OnSale(state)).To(Equal(52))
+			Expect(strategy.OnTick(state)).To(Equal(48))
+			Expect(strategy.OnCrash(state)).To(Equal(20))
+		})
+
+		It("should decay the premium over the floor exponentially", func() {
+			strategy := ExponentialDecayStrategy{Increment: 0.04, Decay: 0.5}
+
+			Expect(strategy.OnTick(state)).To(Equal(35))
+		})
+
+		It("should settle once the premium has decayed to the floor", func() {
+			history := NewHistory(100, RealClock())
+			product := NewProduct(1, "Beer", 100, WithHistory(history), WithStrategy(ExponentialDecayStrategy{Increment: 0.04, Decay: 0.5}))
+			product.IncrPrice()
+			for i := 0; i < 10; i++ {
+				product.DecrPrice()
+			}
+			settled := len(history.Between(1, time.Time{}, time.Time{}))
+
+			product.DecrPrice()
+			Expect(product.Trend).To(BeEmpty())
+			Expect(history.Between(1, time.Time{}, time.Time{})).To(HaveLen(settled))
+		})
+
+		It("should rise faster as sales accumulate", func() {
+			strategy := DemandElasticityStrategy{Increment: 0.25, Elasticity: 1}
+
+			Expect(strategy.OnSale(state)).To(Equal(63))
+
+			busy := state
+			busy.Sales = 1
+			Expect(strategy.OnSale(busy)).To(Equal(75))
+		})
+	})
+
+	Describe("Rounding", func() {
+		It("should round to the nearest step", func() {
+			rounding := RoundingConfig{Type: RoundingNearest, Step: 5}.Rounding()
+
+			Expect(rounding.Round(212, 0)).To(Equal(210))
+			Expect(rounding.Round(213, 0)).To(Equal(215))
+		})
+
+		It("should round charm prices to end in 9", func() {
+			rounding := RoundingConfig{Type: RoundingCharm}.Rounding()
+
+			Expect(rounding.Round(342, 0)).To(Equal(339))
+			Expect(rounding.Round(346, 0)).To(Equal(349))
+			Expect(rounding.Round(342, 340)).To(Equal(349))
+		})
+
+		It("should round ties up or to even", func() {
+			up := RoundingConfig{Type: RoundingNearest, Step: 10}.Rounding()
+			even := RoundingConfig{Type: RoundingNearest, Step: 10, Ties: TiesHalfEven}.Rounding()
+
+			Expect(up.Round(125, 0)).To(Equal(130))
+			Expect(up.Round(135, 0)).To(Equal(140))
+			Expect(even.Round(125, 0)).To(Equal(120))
+			Expect(even.Round(135, 0)).To(Equal(140))
+		})
+
+		It("should reject rounding without a step", func() {
+			_, err := ParseConfig([]byte(`
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+    rounding:
+      type: nearest
+`))
+			Expect(err).To(MatchError("line 3: product 1: nearest rounding needs a positive step"))
+		})
+	})
+
+	Describe("Money", func() {
+		It("should write pounds by default", func() {
+			Expect(Money{}.Format(123456)).To(Equal("£1,234.56"))
+			Expect(Money{}.Format(5)).To(Equal("£0.05"))
+		})
+
+		It("should write a currency the way its locale does", func() {
+			euros := NewMoney(Currency{Code: "EUR", Symbol: "€", Digits: 2}, language.German)
+			yen := NewMoney(Currency{Code: "JPY", Symbol: "¥"}, language.Japanese)
+
+			Expect(euros.Format(123456)).To(Equal("1.234,56\u00a0€"))
+			Expect(yen.Format(1235)).To(Equal("¥1,235"))
+			Expect(euros.ForLanguage("en-US").Format(450)).To(Equal("€4.50"))
+			Expect(euros.ForLanguage("tlh").Format(450)).To(Equal("4,50\u00a0€"))
+		})
+
+		It("should reject currencies it doesn't know", func() {
+			_, err := ParseConfig([]byte(`
+market:
+  currency: XYZ
+products:
+  - id: 1
+    name: Stella
+    base_price: 540
+`))
+			Expect(err).To(MatchError(`line 2: market: unknown currency "XYZ"`))
+		})
+	})
+
+	Describe("Admin", func() {
+		It("should reject requests without the admin token", func() {
+			resp, err := http.Post(endpoint("/admin/products"), "application/json", strings.NewReader(`{"name": "Guest Ale", "basePrice": 400}`))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should add, update and retire products", func() {
+			resp := adminRequest(http.MethodPost, "/admin/products", `{"id": 10, "name": "Guest Ale", "basePrice": 400}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":10,"low":"£0.80","high":"£0.80","current":"£0.80","lowMinor":80,"highMinor":80,"currentMinor":80,"trend":""}`))
+
+			resp = adminRequest(http.MethodPost, "/admin/products", `{"id": 10, "name": "Another Ale", "basePrice": 400}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+			Expect(strings.Count(getBody("/prices/10/history"), `"cause":"open"`)).To(Equal(1))
+
+			resp = adminRequest(http.MethodPut, "/admin/products/10", `{"name": "Landlord", "basePrice": 500}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(getBody("/menu")).To(ContainSubstring(`{"id":10,"name":"Landlord"}`))
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":10,"low":"£1.00","high":"£1.00","current":"£1.00","lowMinor":100,"highMinor":100,"currentMinor":100,"trend":""}`))
+
+			resp = adminRequest(http.MethodDelete, "/admin/products/10", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+			Expect(getBody("/menu")).NotTo(ContainSubstring(`"id":10`))
+
+			resp = adminRequest(http.MethodDelete, "/admin/products/10", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		It("should freeze, set and crash prices", func() {
+			resp := adminRequest(http.MethodPost, "/admin/products", `{"id": 11, "name": "Porter", "basePrice": 500}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			defer adminRequest(http.MethodDelete, "/admin/products/11", "")
+
+			resp = adminRequest(http.MethodPut, "/admin/products/11/price", `{"currentPrice": 350}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":11,"low":"£1.00","high":"£3.50","current":"£3.50","lowMinor":100,"highMinor":350,"currentMinor":350,"trend":"up"}`))
+
+			resp = adminRequest(http.MethodPut, "/admin/products/11/price", `{"currentPrice": 450}`)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			resp = adminRequest(http.MethodPost, "/admin/products/11/freeze", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(getBody("/prices")).To(ContainSubstring(`"current":"£3.50","lowMinor":100,"highMinor":350,"currentMinor":350,"trend":"up","frozen":true}`))
+
+			resp = adminRequest(http.MethodPost, "/admin/products/11/crash", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+
+			resp = adminRequest(http.MethodPost, "/admin/products/11/unfreeze", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			resp = adminRequest(http.MethodPost, "/admin/products/11/crash", "")
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":11,"low":"£1.00","high":"£3.50","current":"£1.00","lowMinor":100,"highMinor":350,"currentMinor":100,"trend":"down"}`))
+			Expect(getBody("/crashes")).To(ContainSubstring(`"type":"manual","productId":11`))
+
+			history := getBody("/prices/11/history")
+			Expect(history).To(ContainSubstring(`"price":"£3.50","priceMinor":350,"cause":"admin"`))
+			Expect(history).To(ContainSubstring(`"price":"£3.50","priceMinor":350,"cause":"freeze"`))
+			Expect(history).To(ContainSubstring(`"price":"£1.00","priceMinor":100,"cause":"crash"`))
+		})
+	})
+
+	Describe("Broker", func() {
+		It("should number events and replay the ones a subscriber missed", func() {
+			broker := NewBroker()
+			broker.Publish(MarketEvent{Type: "price", ProductID: 1})
+			second := broker.Publish(MarketEvent{Type: "crash", ProductID: 1})
+			Expect(second.Seq).To(Equal(uint64(2)))
+
+			subscription, missed := broker.Subscribe(1)
+			defer subscription.Close()
+			Expect(missed).To(HaveLen(1))
+			Expect(missed[0].Type).To(Equal("crash"))
+
+			broker.Publish(MarketEvent{Type: "price", ProductID: 2})
+			Eventually(subscription.C).Should(Receive(WithTransform(func(event MarketEvent) uint64 {
+				return event.Seq
+			}, Equal(uint64(3)))))
+		})
+
+		It("should drop subscribers that fall behind", func() {
+			broker := NewBroker()
+			subscription, _ := broker.Subscribe(0)
+
+			for i := 0; i < 100; i++ {
+				broker.Publish(MarketEvent{Type: "price", ProductID: 1})
+			}
+
+			Eventually(func() bool {
+				select {
+				case _, ok := <-subscription.C:
+					return !ok
+				default:
+					return false
+				}
+			}).Should(BeTrue())
+		})
+
+		It("should end every subscription when closed", func() {
+			broker := NewBroker()
+			subscription, _ := broker.Subscribe(0)
+
+			broker.Close()
+			Expect(broker.Closed()).To(BeTrue())
+			Eventually(subscription.C).Should(BeClosed())
+
+			late, _ := broker.Subscribe(0)
+			Eventually(late.C).Should(BeClosed())
+		})
+	})
+
+	Describe("Stream", func() {
+		It("should push price changes as server-sent events", func() {
+			resp, err := http.Get(endpoint("/stream"))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+			sale, err := http.Post(endpoint("/events"), "application/json", strings.NewReader(`{
+				"bill": { "id": 100, "products": [{ "flypayProductId": 2 }] }
+			}`))
+			Expect(err).NotTo(HaveOccurred())
+			sale.Body.Close()
+
+			lines := readLines(resp.Body)
+			Eventually(lines).Should(Receive(Equal("event: price")))
+			Eventually(lines).Should(Receive(ContainSubstring(`"productId":2`)))
+		})
+
+		It("should push products added, repriced and retired", func() {
+			resp, err := http.Get(endpoint("/stream"))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			lines := readLines(resp.Body)
+
+			adminRequest(http.MethodPost, "/admin/products", `{"id": 12, "name": "Stout", "basePrice": 400}`)
+			Eventually(lines).Should(Receive(Equal("event: added")))
+			Eventually(lines).Should(Receive(ContainSubstring(`"productId":12`)))
+
+			adminRequest(http.MethodPut, "/admin/products/12", `{"basePrice": 500}`)
+			Eventually(lines).Should(Receive(Equal("event: price")))
+			Eventually(lines).Should(Receive(ContainSubstring(`"current":"£1.00"`)))
+
+			adminRequest(http.MethodDelete, "/admin/products/12", "")
+			Eventually(lines).Should(Receive(Equal("event: retired")))
+		})
+
+		It("should resume from Last-Event-ID", func() {
+			req, err := http.NewRequest(http.MethodGet, endpoint("/stream"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Last-Event-ID", "0")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			lines := readLines(resp.Body)
+			Eventually(lines).Should(Receive(Equal("id: 1")))
+		})
+	})
+
+	Describe("Socket", func() {
+		It("should only send updates for subscribed products", func() {
+			conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+
+			fmt.Fprintf(conn, "GET /socket?products=3 HTTP/1.1\r\n"+
+				"Host: %s\r\n"+
+				"Connection: Upgrade\r\n"+
+				"Upgrade: websocket\r\n"+
+				"Sec-WebSocket-Version: 13\r\n"+
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", host)
+
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+			Expect(resp.Header.Get("Sec-WebSocket-Accept")).To(Equal("s3pPLMBiTxaQ9kYGzzhZRbK+xOo="))
+
+			for _, productID := range []int{4, 3} {
+				sale, err := http.Post(endpoint("/events"), "application/json", strings.NewReader(fmt.Sprintf(`{
+					"bill": { "id": %d, "products": [{ "flypayProductId": %d }] }
+				}`, 200+productID, productID)))
+				Expect(err).NotTo(HaveOccurred())
+				sale.Body.Close()
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			header := make([]byte, 2)
+			_, err = io.ReadFull(reader, header)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(header[0]).To(Equal(byte(0x81)))
+
+			length := int(header[1])
+			if length == 126 {
+				extended := make([]byte, 2)
+				_, err = io.ReadFull(reader, extended)
+				Expect(err).NotTo(HaveOccurred())
+				length = int(extended[0])<<8 | int(extended[1])
+			}
+
+			payload := make([]byte, length)
+			_, err = io.ReadFull(reader, payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(payload)).To(ContainSubstring(`"productId":3`))
+		})
+	})
+
+	Describe("History", func() {
+		It("should keep a bounded number of points per product", func() {
+			history := NewHistory(2, RealClock())
+			history.Record(1, 100, "sale")
+			history.Record(1, 110, "sale")
+			history.Record(1, 90, "tick")
+			history.Record(2, 50, "open")
+
+			points := history.Between(1, time.Time{}, time.Time{})
+			Expect(points).To(HaveLen(2))
+			Expect(points[0].Price).To(Equal(110))
+			Expect(points[1].Price).To(Equal(90))
+			Expect(points[1].Cause).To(Equal("tick"))
+		})
+
+		It("should reload points persisted to disk", func() {
+			dir, err := ioutil.TempDir("", "hhse")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "history.jsonl")
+
+			history, err := OpenHistory(10, path, RealClock())
+			Expect(err).NotTo(HaveOccurred())
+			history.Record(1, 100, "sale")
+			Expect(history.Close()).To(Succeed())
+
+			history, err = OpenHistory(10, path, RealClock())
+			Expect(err).NotTo(HaveOccurred())
+			defer history.Close()
+			Expect(history.Between(1, time.Time{}, time.Time{})).To(HaveLen(1))
+		})
+
+		It("should serve the price history of a product", func() {
+			body := getBody("/prices/1/history")
+			Expect(body).To(ContainSubstring(`"price":"£1.08","priceMinor":108,"cause":"open"`))
+			Expect(body).To(ContainSubstring(`"price":"£1.18","priceMinor":118,"cause":"sale"`))
+
+			future := time.Now().Add(time.Hour).Format(time.RFC3339)
+			Expect(getBody("/prices/1/history?since=" + future)).To(MatchJSON(`{"id": 1, "history": []}`))
+		})
+
+		It("should keep the history of retired products", func() {
+			Expect(getBody("/prices/10/history")).To(ContainSubstring(`"cause":"admin"`))
+		})
+	})
+
+	Describe("Snapshot", func() {
+		config, _ := ParseConfig([]byte(`
+market:
+  strategy:
+    type: linear
+    step: 10
+products:
+  - id: 1
+    name: Stella
+    base_price: 500
+`))
+
+		var dir, path string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "hhse")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(dir, "snapshot.json")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should restore prices and products added at runtime", func() {
+			running, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+			menu := running.Default.Menu
+
+			stella, _ := menu.Product(1)
+			for i := 0; i < 3; i++ {
+				stella.IncrPrice()
+			}
+			guest := running.Default.Config.NewProduct(ProductConfig{ID: 2, Name: "Guest Ale", BasePrice: 400}, menu.ProductOptions()...)
+			Expect(menu.Add(guest)).To(Succeed())
+
+			snapshot := running.Snapshot()
+			Expect(WriteSnapshot(path, snapshot)).To(Succeed())
+
+			restarted, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+			read, ok, err := ReadSnapshot(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			restarted.Restore(read, read.Time)
+
+			stella, _ = restarted.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(130))
+			Expect(stella.Trend).To(Equal(TrendUp))
+			guest, err = restarted.Default.Menu.Product(2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(guest.Name).To(Equal("Guest Ale"))
+
+			points := restarted.Default.Menu.History.Between(1, time.Time{}, time.Now())
+			last := points[len(points)-1]
+			Expect(last.Price).To(Equal(130))
+			Expect(last.Cause).To(Equal(CauseRestore))
+		})
+
+		It("should keep the config's base price unless staff changed it", func() {
+			running, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+			stella, _ := running.Default.Menu.Product(1)
+			for i := 0; i < 3; i++ {
+				stella.IncrPrice()
+			}
+			snapshot := running.Snapshot()
+
+			repriced, err := ParseConfig([]byte(`
+market:
+  strategy:
+    type: linear
+    step: 10
+products:
+  - id: 1
+    name: Stella Artois
+    base_price: 600
+    cost_price: 300
+`))
+			Expect(err).NotTo(HaveOccurred())
+			restarted, _ := repriced.Markets()
+			restarted.Restore(snapshot, snapshot.Time)
+			stella, _ = restarted.Default.Menu.Product(1)
+			Expect(stella.Name).To(Equal("Stella Artois"))
+			Expect(stella.BasePrice).To(Equal(600))
+			Expect(stella.Current()).To(Equal(300))
+
+			stella, _ = running.Default.Menu.Product(1)
+			Expect(stella.SetBasePrice(700)).To(Succeed())
+			snapshot = running.Snapshot()
+			restarted, _ = repriced.Markets()
+			restarted.Restore(snapshot, snapshot.Time)
+			stella, _ = restarted.Default.Menu.Product(1)
+			Expect(stella.BasePrice).To(Equal(700))
+
+			snapshot.Markets[0].Products[0].BasePrice = 350
+			restarted, _ = repriced.Markets()
+			restarted.Restore(snapshot, snapshot.Time)
+			stella, _ = restarted.Default.Menu.Product(1)
+			Expect(stella.BasePrice).To(Equal(600))
+		})
+
+		It("should remember bills already counted", func() {
+			bill := func(lines int) string {
+				products := strings.TrimSuffix(strings.Repeat(`{"flypayProductId":1},`, lines), ",")
+				return fmt.Sprintf(`{"time":%q,"type":"bill","locationId":0,"event":{"type":"","bill":{"id":7,"locationId":0,"products":[%s]}}}`,
+					time.Now().Format(time.RFC3339Nano), products)
+			}
+
+			running, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(Replay(running, strings.NewReader(bill(2)), time.Time{}, nil)).To(Succeed())
+			snapshot := running.Snapshot()
+
+			restarted, _ := config.Markets()
+			restarted.Restore(snapshot, snapshot.Time)
+			stella, _ := restarted.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(120))
+			Expect(Replay(restarted, strings.NewReader(bill(2)), time.Time{}, nil)).To(Succeed())
+			Expect(stella.Current()).To(Equal(120))
+			Expect(Replay(restarted, strings.NewReader(bill(3)), time.Time{}, nil)).To(Succeed())
+			Expect(stella.Current()).To(Equal(130))
+
+			restarted, _ = config.Markets()
+			restarted.Restore(snapshot, snapshot.Time.Add(25*time.Hour))
+			stella, _ = restarted.Default.Menu.Product(1)
+			Expect(Replay(restarted, strings.NewReader(bill(2)), time.Time{}, nil)).To(Succeed())
+			Expect(stella.Current()).To(BeNumerically(">", 100))
+		})
+
+		It("should apply the ticks missed while the market was down", func() {
+			running, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+			stella, _ := running.Default.Menu.Product(1)
+			for i := 0; i < 3; i++ {
+				stella.IncrPrice()
+			}
+			snapshot := running.Snapshot()
+
+			restarted, _ := config.Markets()
+			restarted.Restore(snapshot, snapshot.Time.Add(2*time.Minute+time.Second))
+			stella, _ = restarted.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(110))
+
+			restarted, _ = config.Markets()
+			restarted.Restore(snapshot, snapshot.Time.Add(24*time.Hour))
+			stella, _ = restarted.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(100))
+		})
+
+		It("should start fresh without a snapshot", func() {
+			_, ok, err := ReadSnapshot(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("EventLog", func() {
+		config, _ := ParseConfig([]byte(`
+market:
+  strategy:
+    type: linear
+    step: 10
+products:
+  - id: 1
+    name: Stella
+    base_price: 500
+`))
+		eventLog := `{"time":"2017-06-15T22:10:00Z","type":"bill","locationId":0,"event":{"type":"","bill":{"id":7,"locationId":0,"products":[{"flypayProductId":1,"quantity":3}]}}}
+{"time":"2017-06-15T22:11:00Z","type":"tick","locationId":0,"productId":1}
+{"time":"2017-06-15T22:12:00Z","type":"bill","locationId":0,"event":{"type":"void","bill":{"id":7,"locationId":0,"products":[{"flypayProductId":1}]}}}
+{"time":"2017-06-15T22:20:00Z","type":"tick","locationId":0,"productId":1}
+`
+
+		It("should rebuild prices from the log", func() {
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(Replay(markets, strings.NewReader(eventLog), time.Time{}, nil)).To(Succeed())
+
+			stella, _ := markets.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(100))
+		})
+
+		It("should replay each entry at the time it was logged", func() {
+			start := time.Date(2017, 6, 15, 22, 0, 0, 0, time.UTC)
+			markets, err := config.MarketsOn(NewReplayClock(start))
+			Expect(err).NotTo(HaveOccurred())
+
+			// A day later the bill has been forgotten, so it counts again.
+			resent := `{"time":"2017-06-16T23:30:00Z","type":"bill","locationId":0,"event":{"type":"","bill":{"id":7,"locationId":0,"products":[{"flypayProductId":1,"quantity":3}]}}}`
+			Expect(Replay(markets, strings.NewReader(eventLog+resent), time.Time{}, nil)).To(Succeed())
+
+			var times []time.Time
+			for _, point := range markets.Default.Menu.History.Between(1, time.Time{}, time.Time{}) {
+				times = append(times, point.Time)
+			}
+			sold, resold := start.Add(10*time.Minute), time.Date(2017, 6, 16, 23, 30, 0, 0, time.UTC)
+			Expect(times).To(Equal([]time.Time{
+				start,
+				sold, sold, sold,
+				start.Add(11 * time.Minute),
+				start.Add(12 * time.Minute),
+				start.Add(20 * time.Minute),
+				resold, resold, resold,
+			}))
+			stella, _ := markets.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(130))
+		})
+
+		It("should leave history already on disk alone when replaying", func() {
+			dir, err := ioutil.TempDir("", "hhse")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "history.jsonl")
+
+			persisted, err := ParseConfig([]byte(fmt.Sprintf(`
+history:
+  path: %s
+products:
+  - id: 1
+    name: Stella
+    base_price: 500
+`, path)))
+			Expect(err).NotTo(HaveOccurred())
+
+			replay := func() []PricePoint {
+				markets, err := persisted.MarketsOn(NewReplayClock(time.Date(2017, 6, 15, 22, 0, 0, 0, time.UTC)))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(Replay(markets, strings.NewReader(eventLog), time.Time{}, nil)).To(Succeed())
+				history := markets.Default.Menu.History
+				defer history.Close()
+				return history.Between(1, time.Time{}, time.Time{})
+			}
+
+			points := replay()
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(replay()).To(Equal(points))
+			Expect(ioutil.ReadFile(path)).To(Equal(data))
+		})
+
+		It("should hand timers over to the real clock once replay is done", func() {
+			clock := NewReplayClock(time.Now().Add(-time.Minute))
+			due := clock.After(30 * time.Second)
+			later := clock.After(time.Minute + 100*time.Millisecond)
+			stopped := clock.NewTimer(time.Minute + 100*time.Millisecond)
+
+			clock.Live()
+			Expect(clock.Now()).To(BeTemporally("~", time.Now(), time.Second))
+			Expect(due).To(Receive())
+			Expect(later).NotTo(Receive())
+			Expect(stopped.Stop()).To(BeTrue())
+			Eventually(later).Should(Receive())
+			Consistently(stopped.C(), 200*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("should explain prices up to a time", func() {
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			var trace strings.Builder
+			until := time.Date(2017, 6, 15, 22, 14, 0, 0, time.UTC)
+			Expect(Replay(markets, strings.NewReader(eventLog), until, &trace)).To(Succeed())
+
+			Expect(trace.String()).To(Equal(`2017-06-15T22:10:00Z bill location 0: Stella £1.30
+2017-06-15T22:11:00Z tick location 0: Stella £1.20
+2017-06-15T22:12:00Z bill location 0: Stella £1.10
+`))
+		})
+
+		It("should replay what bar staff did", func() {
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			staff := `{"time":"2017-06-15T22:00:00Z","type":"admin","locationId":0,"productId":1,"action":"price","price":300}
+{"time":"2017-06-15T22:01:00Z","type":"admin","locationId":0,"productId":1,"action":"freeze"}
+{"time":"2017-06-15T22:02:00Z","type":"tick","locationId":0,"productId":1}
+`
+			Expect(Replay(markets, strings.NewReader(staff), time.Time{}, nil)).To(Succeed())
+
+			stella, _ := markets.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(300))
+			Expect(stella.Frozen()).To(BeTrue())
+		})
+
+		It("should replay changes bar staff made to the menu", func() {
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			staff := `{"time":"2017-06-15T22:00:00Z","type":"admin","locationId":0,"productId":2,"action":"create","product":{"id":2,"name":"Guest Ale","basePrice":400}}
+{"time":"2017-06-15T22:01:00Z","type":"admin","locationId":0,"productId":2,"action":"update","product":{"name":"Guest Ale (pint)","basePrice":800}}
+{"time":"2017-06-15T22:02:00Z","type":"admin","locationId":0,"productId":2,"action":"price","price":600}
+{"time":"2017-06-15T22:03:00Z","type":"admin","locationId":0,"productId":1,"action":"retire"}
+`
+			Expect(Replay(markets, strings.NewReader(staff), time.Time{}, nil)).To(Succeed())
+
+			guest, err := markets.Default.Menu.Product(2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(guest.Name).To(Equal("Guest Ale (pint)"))
+			Expect(guest.BasePrice).To(Equal(800))
+			Expect(guest.Current()).To(Equal(600))
+			_, err = markets.Default.Menu.Product(1)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should replay a log across restarts", func() {
+			bill := func(id int, at string) string {
+				return fmt.Sprintf(`{"time":%q,"type":"bill","locationId":0,"event":{"type":"","bill":{"id":%d,"locationId":0,"products":[{"flypayProductId":1}]}}}
+`, at, id)
+			}
+			restart := func(markets *Markets, at time.Time) string {
+				snapshot := markets.Default.Snapshot()
+				data, err := json.Marshal(LogEntry{Time: at, Type: LogRestore, Snapshot: &snapshot})
+				Expect(err).NotTo(HaveOccurred())
+				return string(data) + "\n"
+			}
+
+			before := `{"time":"2017-06-15T22:00:00Z","type":"admin","locationId":0,"productId":2,"action":"create","product":{"id":2,"name":"Guest Ale","basePrice":400}}
+` + bill(1, "2017-06-15T22:01:00Z") + bill(2, "2017-06-15T22:01:00Z") + bill(3, "2017-06-15T22:01:00Z")
+			running, _ := config.Markets()
+			Expect(Replay(running, strings.NewReader(before), time.Time{}, nil)).To(Succeed())
+			snapshot := running.Snapshot()
+
+			// Restarted from the snapshot two minutes on, the clock ticks
+			// it caught up on aren't in the log.
+			fromSnapshot, _ := config.Markets()
+			fromSnapshot.Restore(snapshot, snapshot.Time.Add(2*time.Minute+time.Second))
+			log := before + restart(fromSnapshot, time.Date(2017, 6, 15, 22, 5, 0, 0, time.UTC))
+			Expect(Replay(fromSnapshot, strings.NewReader(bill(4, "2017-06-15T22:05:30Z")), time.Time{}, nil)).To(Succeed())
+			log += bill(4, "2017-06-15T22:05:30Z")
+
+			replayed, _ := config.Markets()
+			Expect(Replay(replayed, strings.NewReader(log), time.Time{}, nil)).To(Succeed())
+			Expect(replayed.Default.Snapshot().Products).To(Equal(fromSnapshot.Default.Snapshot().Products))
+
+			// Restarted without a snapshot, prices start again from the
+			// floor and products added at runtime are gone.
+			fresh, _ := config.Markets()
+			log += restart(fresh, time.Date(2017, 6, 15, 23, 0, 0, 0, time.UTC))
+			Expect(Replay(fresh, strings.NewReader(bill(5, "2017-06-15T23:00:30Z")), time.Time{}, nil)).To(Succeed())
+			log += bill(5, "2017-06-15T23:00:30Z")
+
+			replayed, _ = config.Markets()
+			Expect(Replay(replayed, strings.NewReader(log), time.Time{}, nil)).To(Succeed())
+			stella, _ := replayed.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(110))
+			_, err := replayed.Default.Menu.Lookup(2)
+			Expect(err).To(HaveOccurred())
+			Expect(replayed.Default.Snapshot().Products).To(Equal(fresh.Default.Snapshot().Products))
+		})
+
+		It("should reject entries it can't replay", func() {
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = Replay(markets, strings.NewReader(`{"type":"refill"}`), time.Time{}, nil)
+			Expect(err).To(MatchError(`line 1: unknown entry type "refill"`))
+		})
+	})
+
+	Describe("Compliance", func() {
+		It("should serve the compliance report", func() {
+			Expect(getBody("/compliance")).To(HavePrefix(`{"floors":[],"clamps":[]}`))
+		})
+	})
+
+	Describe("Crashes", func() {
+		It("should serve crash history and active crashes", func() {
+			Expect(getBody("/crashes")).To(HavePrefix(`{"crashes":[`))
+			Expect(getBody("/locations/999/crashes/active")).To(Equal("location 999 not found"))
+		})
+	})
+
+	Describe("Candles", func() {
+		start := time.Date(2017, 6, 15, 20, 0, 0, 0, time.UTC)
+
+		It("should aggregate prices into intervals", func() {
+			points := []PricePoint{
+				{Time: start, Price: 100, Cause: "open"},
+				{Time: start.Add(10 * time.Second), Price: 110, Cause: "sale"},
+				{Time: start.Add(20 * time.Second), Price: 120, Cause: "sale"},
+				{Time: start.Add(30 * time.Second), Price: 95, Cause: "tick"},
+				{Time: start.Add(150 * time.Second), Price: 90, Cause: "tick"},
+			}
+
+			sales := []PricePoint{
+				{Time: start.Add(10 * time.Second), Price: 110, Sales: 1},
+				{Time: start.Add(20 * time.Second), Price: 120, Sales: 2},
+				{Time: start.Add(40 * time.Second), Price: 95, Sales: -1},
+				{Time: start.Add(90 * time.Second), Price: 95, Sales: 1},
+			}
+
+			candles := Candles(points, sales, time.Minute, time.Time{}, start.Add(3*time.Minute))
+			Expect(candles).To(HaveLen(3))
+			Expect(candles[0]).To(Equal(Candle{Time: start, Open: 100, High: 120, Low: 95, Close: 95, Volume: 2}))
+			Expect(candles[1]).To(Equal(Candle{Time: start.Add(time.Minute), Open: 95, High: 95, Low: 95, Close: 95, Volume: 1}))
+			Expect(candles[2]).To(Equal(Candle{Time: start.Add(2 * time.Minute), Open: 95, High: 95, Low: 90, Close: 90}))
+
+			candles = Candles(points, sales, time.Minute, start.Add(time.Minute), start.Add(2*time.Minute))
+			Expect(candles).To(Equal([]Candle{{Time: start.Add(time.Minute), Open: 95, High: 95, Low: 95, Close: 95, Volume: 1}}))
+		})
+
+		It("should serve candles for a product", func() {
+			body := getBody("/prices/1/candles?interval=5m")
+			Expect(body).To(ContainSubstring(`"interval":"5m"`))
+			Expect(body).To(ContainSubstring(`"high":"£1.18"`))
+			Expect(body).To(MatchRegexp(`"close":"£1.18",.*"closeMinor":118,"volume":\d+}]}`))
+			Expect(getBody("/prices/1/candles?since=2017-06-15T20:00:00Z&until=2017-06-15T21:00:00Z")).To(ContainSubstring(`"candles":[]`))
+
+			var future struct{ Candles []struct{ Time time.Time } }
+			Expect(json.Unmarshal([]byte(getBody("/prices/1/candles?until=2100-01-01T00:00:00Z")), &future)).To(Succeed())
+			Expect(future.Candles).NotTo(BeEmpty())
+			Expect(future.Candles[len(future.Candles)-1].Time).To(BeTemporally("<=", time.Now()))
+		})
+
+		It("should reject unknown intervals", func() {
+			resp, err := http.Get(endpoint("/prices/1/candles?interval=2m"))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("Events", func() {
+		It("should only count bill lines once", func() {
+			postBill(`{"bill": {"id": 500, "locationId": 123, "lastUpdated": "2017-06-15 20:00:00", "products": [
+				{ "flypayProductId": 5 }
+			]}}`)
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":5,"low":"£0.96","high":"£1.00","current":"£1.00","lowMinor":96,"highMinor":100,"currentMinor":100,"trend":"up"}`))
+
+			postBill(`{"bill": {"id": 500, "locationId": 123, "lastUpdated": "2017-06-15 20:00:00", "products": [
+				{ "flypayProductId": 5 }
+			]}}`)
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":5,"low":"£0.96","high":"£1.00","current":"£1.00","lowMinor":96,"highMinor":100,"currentMinor":100,"trend":"up"}`))
+
+			postBill(`{"bill": {"id": 500, "locationId": 123, "lastUpdated": "2017-06-15 20:05:00", "products": [
+				{ "flypayProductId": 5 },
+				{ "flypayProductId": 5 }
+			]}}`)
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":5,"low":"£0.96","high":"£1.04","current":"£1.04","lowMinor":96,"highMinor":104,"currentMinor":104,"trend":"up"}`))
+		})
+
+		It("should tell bills at different locations apart", func() {
+			postBill(`{"bill": {"id": 500, "locationId": 456, "products": [
+				{ "flypayProductId": 5 }
+			]}}`)
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":5,"low":"£0.96","high":"£1.09","current":"£1.09","lowMinor":96,"highMinor":109,"currentMinor":109,"trend":"up"}`))
+		})
+
+		It("should reverse sales taken off a re-sent bill", func() {
+			postBill(`{"bill": {"id": 500, "locationId": 123, "lastUpdated": "2017-06-15 20:10:00", "products": [
+				{ "flypayProductId": 5 }
+			]}}`)
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":5,"low":"£0.96","high":"£1.09","current":"£1.04","lowMinor":96,"highMinor":109,"currentMinor":104,"trend":"down"}`))
+		})
+
+		It("should reverse voided sales once", func() {
+			void := `{"type": "void", "bill": {"id": 500, "locationId": 456, "lastUpdated": "2017-06-15 20:15:00", "products": [
+				{ "flypayProductId": 5 }
+			]}}`
+			postBill(void)
+			postBill(void)
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":5,"low":"£0.96","high":"£1.09","current":"£1.00","lowMinor":96,"highMinor":109,"currentMinor":100,"trend":"down"}`))
+			Expect(getBody("/prices/5/history")).To(ContainSubstring(`"price":"£1.00","priceMinor":100,"cause":"refund"`))
+		})
+
+		It("should count every item on a line with a quantity", func() {
+			postBill(`{"bill": {"id": 600, "locationId": 123, "products": [
+				{ "flypayProductId": 4, "quantity": 3 }
+			]}}`)
+			Expect(getBody("/prices")).To(ContainSubstring(`{"id":4,"low":"£0.96","high":"£1.14","current":"£1.14","lowMinor":96,"highMinor":114,"currentMinor":114,"trend":"up"}`))
+		})
+
+		It("should refund lines with a negative quantity", func() {
+			config, err := ParseConfig([]byte(`
+market:
+  strategy:
+    type: linear
+    step: 10
+products:
+  - id: 1
+    name: Stella
+    base_price: 500
+`))
+			Expect(err).NotTo(HaveOccurred())
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			refund := `{"time":"2017-06-15T22:10:00Z","type":"bill","locationId":0,"event":{"type":"","bill":{"id":8,"locationId":0,"products":[{"id":"a","flypayProductId":1,"quantity":3},{"id":"b","flypayProductId":1,"quantity":-1}]}}}
+`
+			Expect(Replay(markets, strings.NewReader(refund+refund), time.Time{}, nil)).To(Succeed())
+
+			stella, _ := markets.Default.Menu.Product(1)
+			Expect(stella.Current()).To(Equal(120))
+		})
+
+		It("should refuse lines for more items than any bill has", func() {
+			resp, err := http.Post(endpoint("/events"), "application/json", strings.NewReader(`{"bill": {"id": 602, "locationId": 123, "products": [
+				{ "flypayProductId": 4, "quantity": 1e12 }
+			]}}`))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			markets, err := DefaultConfig().Markets()
+			Expect(err).NotTo(HaveOccurred())
+			err = Replay(markets, strings.NewReader(`{"type":"bill","event":{"bill":{"id":1,"products":[{"flypayProductId":1,"quantity":600},{"flypayProductId":2,"quantity":600}]}}}`), time.Time{}, nil)
+			Expect(err).To(MatchError("line 1: bill 1: quantity can't be more than 1000 in total"))
+		})
+
+		It("should read bill times in the venue's time zone", func() {
+			config, err := ParseConfig([]byte(`
+timezone: America/Los_Angeles
+products:
+  - id: 1
+    name: Stella
+    base_price: 500
+`))
+			Expect(err).NotTo(HaveOccurred())
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			venue, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			now := time.Now().Add(time.Second)
+			entry := fmt.Sprintf(`{"time":%q,"type":"bill","locationId":0,"event":{"type":"","bill":{"id":1,"locationId":0,"lastUpdated":%q,"products":[{"flypayProductId":1,"price":9.99}]}}}`,
+				now.Format(time.RFC3339), now.In(venue).Format("2006-01-02 15:04:05"))
+			Expect(Replay(markets, strings.NewReader(entry), time.Time{}, nil)).To(Succeed())
+
+			mismatches := markets.Default.Menu.Bills.Mismatches()
+			Expect(mismatches).To(HaveLen(1))
+			Expect(mismatches[0].Shown).To(Equal(100))
+		})
+
+		It("should read charged prices in the market's currency", func() {
+			config, err := ParseConfig([]byte(`
+market:
+  currency: JPY
+products:
+  - id: 1
+    name: Asahi
+    base_price: 500
+  - id: 2
+    name: Sapporo
+    base_price: 500
+`))
+			Expect(err).NotTo(HaveOccurred())
+			markets, err := config.Markets()
+			Expect(err).NotTo(HaveOccurred())
+
+			now := time.Now().Add(time.Second)
+			entry := fmt.Sprintf(`{"time":%q,"type":"bill","locationId":0,"event":{"type":"","bill":{"id":1,"locationId":0,"lastUpdated":%q,"products":[{"flypayProductId":1,"price":100},{"flypayProductId":2,"price":550}]}}}`,
+				now.Format(time.RFC3339), now.Format("2006-01-02 15:04:05"))
+			Expect(Replay(markets, strings.NewReader(entry), time.Time{}, nil)).To(Succeed())
+
+			mismatches := markets.Default.Menu.Bills.Mismatches()
+			Expect(mismatches).To(HaveLen(1))
+			Expect(mismatches[0].ProductID).To(Equal(2))
+			Expect(mismatches[0].Charged).To(Equal(550))
+		})
+
+		It("should flag lines charged at a price the market wasn't showing", func() {
+			now := time.Now().Add(time.Second).Format("2006-01-02 15:04:05")
+			postBill(fmt.Sprintf(`{"bill": {"id": 601, "locationId": 123, "lastUpdated": %q, "products": [
+				{ "flypayProductId": 4, "price": 1.14, "priceSold": 0 },
+				{ "flypayProductId": 3, "price": 9.99, "priceSold": 0 }
+			]}}`, now))
+
+			body := getBody("/events/mismatches")
+			Expect(body).To(ContainSubstring(`"billId":601,"locationId":123,"productId":3`))
+			Expect(body).To(ContainSubstring(`"charged":"£9.99"`))
+			Expect(body).NotTo(ContainSubstring(`"productId":4`))
+		})
+	})
+})
+
+func postBill(body string) {
+	resp, err := http.Post(endpoint("/events"), "application/json", strings.NewReader(body))
+	Expect(err).NotTo(HaveOccurred())
+	resp.Body.Close()
+
+	Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+}
+
+func readLines(body io.Reader) chan string {
+	lines := make(chan string, 100)
+	go func() {
+		defer GinkgoRecover()
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+func adminRequest(method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, endpoint(path), strings.NewReader(body))
+	Expect(err).NotTo(HaveOccurred())
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).NotTo(HaveOccurred())
+	resp.Body.Close()
+
+	return resp
+}
+
+func getBody(path string) string {
+	resp, err := http.Get(endpoint(path))
+	Expect(err).NotTo(HaveOccurred())
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	Expect(err).NotTo(HaveOccurred())
+
+	return string(body)
+}
 
 func endpoint(path string) string {
 	path = strings.TrimLeft(path, "/")
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const CauseOpen = "open"
+const CauseSale = "sale"
+const CauseTick = "tick"
+const CauseCrash = "crash"
+const CauseAdmin = "admin"
+const CauseRefund = "refund"
+const CauseFreeze = "freeze"
+const CauseUnfreeze = "unfreeze"
+const CauseSchedule = "schedule"
+const CauseRestore = "restore"
+
+// HistorySize is how many price changes are kept in memory for each product
+// when the configuration doesn't say.
+const HistorySize = 10000
+
+// PricePoint is a price a product moved to, or with Sales set, a number of
+// sales of it at that price.
+type PricePoint struct {
+	ProductID int       `json:"productId"`
+	Time      time.Time `json:"time"`
+	Price     int       `json:"price"`
+	Cause     string    `json:"cause"`
+	Sales     int       `json:"sales,omitempty"`
+}
+
+// History records every price a product has had and the sales it made. Each
+// product keeps a bounded ring of recent points of each in memory; if a file
+// is given, every point is also appended to it as a JSON line and read back
+// on startup. Points no later than the last one in the file are already
+// there, as happens when the event log is replayed, and aren't recorded again.
+type History struct {
+	lock      sync.RWMutex
+	size      int
+	products  map[int]*priceRing
+	sales     map[int]*priceRing
+	file      *os.File
+	persisted time.Time
+	clock     Clock
+}
+
+type priceRing struct {
+	size   int
+	points []PricePoint
+	next   int
+}
+
+// NewHistory keeps up to size points of each kind per product, stamped with
+// the time on clock.
+func NewHistory(size int, clock Clock) *History {
+	if size <= 0 {
+		size = HistorySize
+	}
+
+	return &History{
+		size:     size,
+		products: map[int]*priceRing{},
+		sales:    map[int]*priceRing{},
+		clock:    clock,
+	}
+}
+
+// OpenHistory loads any points already in the file at path and appends new
+// points to it.
+func OpenHistory(size int, path string, clock Clock) (*History, error) {
+	history := NewHistory(size, clock)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var point PricePoint
+		if json.Unmarshal(scanner.Bytes(), &point) != nil {
+			continue
+		}
+		history.ring(point).add(point)
+		if point.Time.After(history.persisted) {
+			history.persisted = point.Time
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	history.file = file
+	return history, nil
+}
+
+func (history *History) Record(productID int, price int, cause string) {
+	history.add(PricePoint{
+		ProductID: productID,
+		Price:     price,
+		Cause:     cause,
+	})
+}
+
+// RecordSales records count sales of a product at price, negative for sales
+// taken back, whether or not they moved the price.
+func (history *History) RecordSales(productID int, count int, price int) {
+	history.add(PricePoint{
+		ProductID: productID,
+		Price:     price,
+		Cause:     CauseSale,
+		Sales:     count,
+	})
+}
+
+func (history *History) add(point PricePoint) {
+	if history == nil {
+		return
+	}
+
+	point.Time = history.clock.Now()
+
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	if !point.Time.After(history.persisted) {
+		return
+	}
+	history.ring(point).add(point)
+
+	if history.file != nil {
+		data, err := json.Marshal(point)
+		if err == nil {
+			history.file.Write(append(data, '\n'))
+		}
+	}
+}
+
+// Between returns a product's recorded prices, oldest first, limited to those
+// at or after since and before until. Zero times leave that end open.
+func (history *History) Between(productID int, since, until time.Time) []PricePoint {
+	return history.between(history.products, productID, since, until)
+}
+
+// SalesBetween returns a product's recorded sales, oldest first, limited as
+// Between is.
+func (history *History) SalesBetween(productID int, since, until time.Time) []PricePoint {
+	return history.between(history.sales, productID, since, until)
+}
+
+func (history *History) between(rings map[int]*priceRing, productID int, since, until time.Time) []PricePoint {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+
+	ring, ok := rings[productID]
+	if !ok {
+		return nil
+	}
+
+	var points []PricePoint
+	for _, point := range ring.ordered() {
+		if !since.IsZero() && point.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !point.Time.Before(until) {
+			continue
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// PriceAt is the price a product was showing at t.
+func (history *History) PriceAt(productID int, t time.Time) (int, bool) {
+	history.lock.RLock()
+	defer history.lock.RUnlock()
+
+	ring, ok := history.products[productID]
+	if !ok {
+		return 0, false
+	}
+
+	price, found := 0, false
+	for _, point := range ring.ordered() {
+		if point.Time.After(t) {
+			break
+		}
+		price, found = point.Price, true
+	}
+	return price, found
+}
+
+func (history *History) Close() error {
+	if history == nil || history.file == nil {
+		return nil
+	}
+
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	err := history.file.Close()
+	history.file = nil
+	return err
+}
+
+// ring finds where a point is kept, apart for sales and prices. It must be
+// called with the history lock held.
+func (history *History) ring(point PricePoint) *priceRing {
+	rings := history.products
+	if point.Sales != 0 {
+		rings = history.sales
+	}
+
+	ring, ok := rings[point.ProductID]
+	if !ok {
+		ring = &priceRing{size: history.size}
+		rings[point.ProductID] = ring
+	}
+	return ring
+}
+
+// add overwrites the oldest point once the ring is full.
+func (ring *priceRing) add(point PricePoint) {
+	if len(ring.points) < ring.size {
+		ring.points = append(ring.points, point)
+		return
+	}
+
+	ring.points[ring.next] = point
+	ring.next = (ring.next + 1) % ring.size
+}
+
+func (ring *priceRing) ordered() []PricePoint {
+	ordered := make([]PricePoint, 0, len(ring.points))
+	ordered = append(ordered, ring.points[ring.next:]...)
+	return append(ordered, ring.points[:ring.next]...)
+}
+
+type historyPointResponse struct {
+	Time       time.Time `json:"time"`
+	Price      string    `json:"price"`
+	PriceMinor int       `json:"priceMinor"`
+	Cause      string    `json:"cause"`
+}
+
+type historyResponse struct {
+	ID      int                    `json:"id"`
+	History []historyPointResponse `json:"history"`
+}
+
+// priceHistory serves a product's recorded prices, optionally limited to
+// RFC 3339 since and until times. Retired products keep their history.
+func priceHistory(w http.ResponseWriter, r *http.Request, market *Market) {
+	productID, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	_, err := market.Menu.Lookup(productID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	since, until, err := timeRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	response := historyResponse{ID: productID, History: []historyPointResponse{}}
+	for _, point := range market.Menu.History.Between(productID, since, until) {
+		response.History = append(response.History, historyPointResponse{
+			Time:       point.Time,
+			Price:      market.Menu.Money.Format(point.Price),
+			PriceMinor: point.Price,
+			Cause:      point.Cause,
+		})
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// timeRange reads the RFC 3339 since and until parameters of a request.
+// Either can be left out.
+func timeRange(r *http.Request) (time.Time, time.Time, error) {
+	var since, until time.Time
+	for name, value := range map[string]*time.Time{"since": &since, "until": &until} {
+		param := r.URL.Query().Get(name)
+		if param == "" {
+			continue
+		}
+		var err error
+		*value, err = time.Parse(time.RFC3339, param)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	return since, until, nil
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"os"
+	"io"
+	"flag"
 	"net/http"
 	"log"
 	"fmt"
 	"github.com/gorilla/mux"
 	"encoding/json"
 	"github.com/rs/cors"
-	"math"
 	"time"
 	"sync"
 )
@@ -21,20 +22,211 @@ const ClockPeriodMinutes = 1
 const TrendUp = "up"
 const TrendDown = "down"
 
-type Menu struct {
-	Items []*Product
-}
+// RefundUndo takes back exactly what the refunded sale added to the price.
+// RefundTick moves the price down as if the clock had ticked.
+const RefundUndo = "undo"
+const RefundTick = "tick"
+
+// maxSaleSteps bounds how many sales back a refund can undo.
+const maxSaleSteps = 100
+
+// CrashWindow is how long displays show a crash for.
+const CrashWindow = 2 * time.Second
 
 type Product struct {
 	ID           int
 	Name         string
+	Category     string
 	BasePrice    int
+	CostPrice    int
+	minMargin    int
+	ABV          float64
+	Volume       int
+	jurisdiction string
+	unitPrice    int
 	lowPrice     int
 	currentPrice int
 	highPrice    int
 	Trend        string
+	lowRatio     float64
+	crashRatio   float64
+	clockPeriod  time.Duration
+	crashWindow  time.Duration
+	cooldown     time.Duration
+	crashHold    int
+	holding      int
+	cooldownEnds time.Time
+	frozen       bool
+	fixed        bool
+	edited       bool
+	schedule     string
+	priceSets    map[string]PriceSet
+	rounding     Rounding
+	money        Money
+	strategy     PricingStrategy
+	refundMode   string
+	sales        int
+	saleSteps    []int
+	events       *Broker
+	history      *History
+	crash        *CrashState
+	compliance   *Compliance
+	log          *EventLog
+	locationID   int
+	clock        Clock
+	scheduler    *Scheduler
 	lock         sync.RWMutex
-	reset        chan struct{}
+}
+
+type ProductOption func(*Product)
+
+// WithStrategy binds a product to a pricing strategy other than the default.
+func WithStrategy(strategy PricingStrategy) ProductOption {
+	return func(product *Product) {
+		product.strategy = strategy
+	}
+}
+
+// WithBroker publishes the product's price changes and crashes to broker.
+func WithBroker(broker *Broker) ProductOption {
+	return func(product *Product) {
+		product.events = broker
+	}
+}
+
+// WithCrash reports the product's crashes to its market's crash state.
+func WithCrash(crash *CrashState) ProductOption {
+	return func(product *Product) {
+		product.crash = crash
+	}
+}
+
+// WithEventLog logs the product's clock ticks to log, as a product of the
+// market at locationID.
+func WithEventLog(log *EventLog, locationID int) ProductOption {
+	return func(product *Product) {
+		product.log = log
+		product.locationID = locationID
+	}
+}
+
+// WithClock runs the product's price decay and crashes on clock.
+func WithClock(clock Clock) ProductOption {
+	return func(product *Product) {
+		product.clock = clock
+	}
+}
+
+// WithScheduler has scheduler tick the product's price down.
+func WithScheduler(scheduler *Scheduler) ProductOption {
+	return func(product *Product) {
+		product.scheduler = scheduler
+	}
+}
+
+// WithHistory records every price the product has in history.
+func WithHistory(history *History) ProductOption {
+	return func(product *Product) {
+		product.history = history
+	}
+}
+
+// WithRefundMode sets how a refunded sale moves the price, RefundUndo or
+// RefundTick.
+func WithRefundMode(mode string) ProductOption {
+	return func(product *Product) {
+		product.refundMode = mode
+	}
+}
+
+// WithRatios sets the fractions of the base price a product bottoms out at
+// and crashes from.
+func WithRatios(lowRatio, crashRatio float64) ProductOption {
+	return func(product *Product) {
+		product.lowRatio = lowRatio
+		product.crashRatio = crashRatio
+	}
+}
+
+// WithCrashTiming sets how long the product's crashes stay on the displays,
+// how long after a crash its price can't climb, and how many ticks it is held
+// at its floor after a crash before the price moves again.
+func WithCrashTiming(window, cooldown time.Duration, hold int) ProductOption {
+	return func(product *Product) {
+		product.crashWindow = window
+		product.cooldown = cooldown
+		product.crashHold = hold
+	}
+}
+
+// WithCategory puts the product in a category, such as "lager", that can
+// crash together.
+func WithCategory(category string) ProductOption {
+	return func(product *Product) {
+		product.Category = category
+	}
+}
+
+// WithCost keeps the product's price at least margin pence above what it
+// costs the bar, whatever its low ratio. A cost of 0 means it isn't known.
+func WithCost(cost, margin int) ProductOption {
+	return func(product *Product) {
+		product.CostPrice = cost
+		product.minMargin = margin
+	}
+}
+
+// WithLegalFloor keeps the product's price at or above the minimum unit
+// price of jurisdiction, unitPrice pence a unit of alcohol, for a drink of abv
+// percent alcohol served volume millilitres at a time.
+func WithLegalFloor(jurisdiction string, unitPrice int, abv float64, volume int) ProductOption {
+	return func(product *Product) {
+		product.jurisdiction = jurisdiction
+		product.unitPrice = unitPrice
+		product.ABV = abv
+		product.Volume = volume
+	}
+}
+
+// WithCompliance reports the prices the product's legal floor raised to
+// compliance.
+func WithCompliance(compliance *Compliance) ProductOption {
+	return func(product *Product) {
+		product.compliance = compliance
+	}
+}
+
+// WithPriceSets gives the ratios and strategy the product prices by under
+// each schedule, by name. The empty name is the set it prices by outside
+// every schedule.
+func WithPriceSets(sets map[string]PriceSet) ProductOption {
+	return func(product *Product) {
+		product.priceSets = sets
+	}
+}
+
+// WithRounding rounds the prices the product is shown and charged at. The
+// market keeps moving the unrounded price, so small steps still add up.
+func WithRounding(rounding Rounding) ProductOption {
+	return func(product *Product) {
+		product.rounding = rounding
+	}
+}
+
+// WithMoney writes the product's prices in a market's currency and locale
+// rather than as pounds.
+func WithMoney(money Money) ProductOption {
+	return func(product *Product) {
+		product.money = money
+	}
+}
+
+// WithClockPeriod sets how long a product goes without a sale before its
+// price drops.
+func WithClockPeriod(period time.Duration) ProductOption {
+	return func(product *Product) {
+		product.clockPeriod = period
+	}
 }
 
 type itemResponse struct {
@@ -48,85 +240,139 @@ type menuResponse struct {
 }
 
 type priceResponse struct {
-	ID      int    `json:"id"`
-	Low     string `json:"low"`
-	High    string `json:"high"`
-	Current string `json:"current"`
-	Trend   string `json:"trend"`
+	ID           int    `json:"id"`
+	Low          string `json:"low"`
+	High         string `json:"high"`
+	Current      string `json:"current"`
+	LowMinor     int    `json:"lowMinor"`
+	HighMinor    int    `json:"highMinor"`
+	CurrentMinor int    `json:"currentMinor"`
+	Trend        string `json:"trend"`
+	Frozen       bool   `json:"frozen,omitempty"`
 }
 
 type pricesResponse struct {
-	Prices []priceResponse `json:"prices"`
-	Crash  *int            `json:"crash"`
+	Currency  string            `json:"currency"`
+	Prices    []priceResponse   `json:"prices"`
+	Crash     *int              `json:"crash"`
+	CrashType string            `json:"crashType,omitempty"`
+	Schedule  *scheduleResponse `json:"schedule,omitempty"`
 }
 
 type billEvent struct {
+	Type string        `json:"type"`
 	Bill billEventBill `json:"bill"`
 }
 
+// Bill events are sales unless their type says the products listed have been
+// taken off the bill.
+const BillEventVoid = "void"
+const BillEventRefund = "refund"
+
 type billEventBill struct {
-	Products []billEventProduct `json:"products"`
+	ID          int                `json:"id"`
+	LocationID  int                `json:"locationId"`
+	OpenedAt    *string            `json:"openedAt"`
+	LastUpdated *string            `json:"lastUpdated"`
+	Products    []billEventProduct `json:"products"`
 }
 
 type billEventProduct struct {
-	ID int `json:"flypayProductId"`
+	LineID    json.RawMessage `json:"id"`
+	ID        int             `json:"flypayProductId"`
+	Quantity  float64         `json:"quantity"`
+	Price     float64         `json:"price"`
+	PriceSold float64         `json:"priceSold"`
 }
 
-var fakeMenu Menu
-
-var crash struct {
-	ID   *int
-	lock sync.RWMutex
-}
+var markets *Markets
 
 func main() {
+	configPath := flag.String("config", os.Getenv("HHSE_CONFIG"), "path to a YAML menu and market configuration file")
+	replay := flag.Bool("replay", false, "rebuild prices by replaying the event log instead of restoring the snapshot")
+	replayUntil := flag.String("replay-until", "", "replay the event log up to an RFC 3339 time, print each price it moved and exit")
+	flag.Parse()
 
-	fakeMenu = Menu{
-		Items: []*Product{
-			NewProduct(1, "Stella", 540),
-			NewProduct(2, "Carlsberg", 480),
-			NewProduct(3, "Coors Light", 420),
-			NewProduct(4, "Carling", 480),
-			NewProduct(5, "Budweiser", 480),
-		},
+	config := DefaultConfig()
+	if *configPath != "" {
+		var err error
+		config, err = LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	}).Methods(http.MethodGet)
+	var err error
+	replaying := *replay || *replayUntil != ""
+	var clock Clock = RealClock()
+	var replayClock *ReplayClock
+	if replaying {
+		if config.EventLog.Path == "" {
+			log.Fatal("replaying needs event_log.path in the config")
+		}
+
+		// The markets start when the log does, so each entry is applied
+		// at the time it was logged.
+		start, err := LogStart(config.EventLog.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replayClock = NewReplayClock(start)
+		clock = replayClock
+	}
+
+	markets, err = config.MarketsOn(clock)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	r.HandleFunc("/menu", func(w http.ResponseWriter, r *http.Request) {
-		var m menuResponse
+	if replaying {
 
-		for _, product := range fakeMenu.Items {
-			product.lock.RLock()
-			m.Items = append(m.Items, itemResponse{
-				ID:   product.ID,
-				Name: product.Name,
-			})
-			product.lock.RUnlock()
+		var until time.Time
+		var trace io.Writer
+		if *replayUntil != "" {
+			until, err = time.Parse(time.RFC3339, *replayUntil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			trace = os.Stdout
 		}
 
-		w.Header().Add("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(m)
-	}).Methods(http.MethodGet)
+		err = ReplayFile(markets, config.EventLog.Path, until, trace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *replayUntil != "" {
+			return
+		}
+		replayClock.Live()
+	} else if config.Snapshot.Path != "" {
+		snapshot, ok, err := ReadSnapshot(config.Snapshot.Path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ok {
+			markets.Restore(snapshot, time.Now())
+		}
+	}
 
-	r.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
-		var p pricesResponse
+	if config.Snapshot.Path != "" {
+		go snapshotEvery(markets, config.Snapshot.Path, config.Snapshot.Interval)
+	}
 
-		for _, product := range fakeMenu.Items {
-			product.lock.RLock()
-			p.Prices = append(p.Prices, newPriceResp(*product))
-			product.lock.RUnlock()
+	if config.EventLog.Path != "" {
+		err = markets.Log.Open(config.EventLog.Path)
+		if err != nil {
+			log.Fatal(err)
 		}
+		markets.LogStartup()
+	}
 
-		crash.lock.RLock()
-		p.Crash = crash.ID
-		crash.lock.RUnlock()
+	markets.Start()
 
-		w.Header().Add("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(p)
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
 	}).Methods(http.MethodGet)
 
 	r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
@@ -138,146 +384,647 @@ func main() {
 			return
 		}
 
-		for _, product := range event.Bill.Products {
-			menuProduct, err := fakeMenu.Product(product.ID)
-			if err != nil {
-				continue
-			}
+		err = event.Bill.validate()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
 
-			menuProduct.IncrPrice()
+		market := markets.For(event.Bill.LocationID)
+		if market == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("location %d not found", event.Bill.LocationID)))
+			return
 		}
+		entry := LogEntry{Type: LogBill, LocationID: event.Bill.LocationID, Event: &event}
+		markets.Log.Record(entry, func() {
+			market.ApplyBill(event)
+		})
 
 		w.WriteHeader(http.StatusNoContent)
 	})
 
+	adminToken := os.Getenv("HHSE_ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Print("HHSE_ADMIN_TOKEN is not set, admin API disabled")
+	}
+
+	// Every venue's routes are served under /locations/{id}, and the default
+	// market's at the top level.
+	location := r.PathPrefix("/locations/{location:[0-9]+}").Subrouter()
+	for _, router := range []*mux.Router{r, location} {
+		registerMarketRoutes(router)
+		if adminToken != "" {
+			registerAdminRoutes(router, adminToken)
+		}
+	}
+
 	c := cors.AllowAll()
 
-	err := http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), c.Handler(r))
+	server := &http.Server{Addr: fmt.Sprintf(":%s", os.Getenv("PORT")), Handler: c.Handler(r)}
+	server.RegisterOnShutdown(markets.CloseStreams)
+
+	err = serve(server, config.Shutdown.Timeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = markets.Close(config.Snapshot.Path)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func NewProduct(ID int, name string, price int) *Product {
-	initialPrice := int(float64(price) * LowRatio)
+func registerMarketRoutes(r *mux.Router) {
+	r.HandleFunc("/menu", withMarket(serveMenu)).Methods(http.MethodGet)
+	r.HandleFunc("/prices", withMarket(servePrices)).Methods(http.MethodGet)
+
+	r.HandleFunc("/prices/{id:[0-9]+}/history", withMarket(priceHistory)).Methods(http.MethodGet)
+	r.HandleFunc("/prices/{id:[0-9]+}/candles", withMarket(priceCandles)).Methods(http.MethodGet)
+
+	r.HandleFunc("/events/mismatches", withMarket(priceMismatches)).Methods(http.MethodGet)
+
+	r.HandleFunc("/crashes", withMarket(serveCrashes)).Methods(http.MethodGet)
+	r.HandleFunc("/crashes/active", withMarket(serveActiveCrashes)).Methods(http.MethodGet)
+
+	r.HandleFunc("/compliance", withMarket(serveCompliance)).Methods(http.MethodGet)
+
+	r.HandleFunc("/stream", withMarket(streamEvents)).Methods(http.MethodGet)
+	r.HandleFunc("/socket", withMarket(priceSocket)).Methods(http.MethodGet)
+}
+
+func serveMenu(w http.ResponseWriter, r *http.Request, market *Market) {
+	var m menuResponse
+
+	for _, product := range market.Menu.Products() {
+		product.lock.RLock()
+		m.Items = append(m.Items, itemResponse{
+			ID:   product.ID,
+			Name: product.Name,
+		})
+		product.lock.RUnlock()
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+func servePrices(w http.ResponseWriter, r *http.Request, market *Market) {
+	money := market.Menu.Money.ForLanguage(r.Header.Get("Accept-Language"))
+	p := pricesResponse{Currency: money.Code()}
+
+	for _, product := range market.Menu.Products() {
+		product.lock.RLock()
+		p.Prices = append(p.Prices, newPriceResp(product, money))
+		product.lock.RUnlock()
+	}
+
+	if crash := market.Menu.Crash.Latest(); crash != nil {
+		p.Crash = &crash.ProductID
+		p.CrashType = crash.Type
+	}
+	p.Schedule = newScheduleResp(market.Menu.Timetable, market.Menu.Clock.Now())
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func NewProduct(ID int, name string, price int, options ...ProductOption) *Product {
 	product := &Product{
-		ID:           ID,
-		Name:         name,
-		BasePrice:    price,
-		lowPrice:     initialPrice,
-		currentPrice: initialPrice,
-		highPrice:    initialPrice,
-		reset:        make(chan struct{}),
+		ID:          ID,
+		Name:        name,
+		BasePrice:   price,
+		lowRatio:    LowRatio,
+		crashRatio:  CrashRatio,
+		clockPeriod: ClockPeriodMinutes * time.Minute,
+		crashWindow: CrashWindow,
+		strategy:    DefaultStrategy(),
+		refundMode:  RefundUndo,
+		clock:       RealClock(),
+	}
+
+	for _, option := range options {
+		option(product)
 	}
 
-	go product.Run()
+	initialPrice := product.clamp(product.marketFloor(), CauseOpen)
+	product.lowPrice = initialPrice
+	product.currentPrice = initialPrice
+	product.highPrice = initialPrice
+	product.history.Record(product.ID, product.Current(), CauseOpen)
+
+	product.scheduler.Add(product)
 
 	return product
 }
 
-func (product *Product) Run() {
-	timer := time.NewTimer(ClockPeriodMinutes * time.Minute)
-	select {
-	case <-timer.C:
-		product.DecrPrice()
-	case <-product.reset:
+// Stop halts the product's clock for good.
+func (product *Product) Stop() {
+	product.scheduler.Remove(product)
+}
+
+func (product *Product) Rename(name string) {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	product.Name = name
+	product.edited = true
+}
+
+// SetBasePrice reprices the product, keeping its current, low and high prices
+// in the same place relative to the new base price but no lower than its
+// floor. A base price that would put the crash price below the floor is
+// refused.
+func (product *Product) SetBasePrice(price int) error {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	floor, err := product.checkBasePrice(price)
+	if err != nil {
+		return err
 	}
-	go product.Run()
+
+	product.rebase(price, floor)
+	product.edited = true
+	product.history.Record(product.ID, product.Current(), CauseAdmin)
+	product.publish(EventPrice)
+	return nil
 }
 
+// rebase moves the base price to price and the current, low and high prices
+// with it, no lower than floor. It must be called with the product lock held.
+func (product *Product) rebase(price, floor int) {
+	rescale := func(amount int) int {
+		amount = amount * price / product.BasePrice
+		if amount < floor {
+			amount = floor
+		}
+		return amount
+	}
+
+	product.currentPrice = rescale(product.currentPrice)
+	product.lowPrice = rescale(product.lowPrice)
+	product.highPrice = rescale(product.highPrice)
+	product.BasePrice = price
+}
+
+// SetPrice moves the current price to price, which must be between the
+// product's floor and the price it crashes from. Sales before it can no longer
+// be refunded off the price.
+func (product *Product) SetPrice(price int) error {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	err := product.checkPrice(price)
+	if err != nil {
+		return err
+	}
+
+	if price > product.currentPrice {
+		product.Trend = TrendUp
+	} else if price < product.currentPrice {
+		product.Trend = TrendDown
+	}
+
+	product.scheduler.Reset(product)
+	product.currentPrice = price
+	product.sales = 0
+	product.saleSteps = nil
+	if price > product.highPrice {
+		product.highPrice = price
+	}
+	if price < product.lowPrice {
+		product.lowPrice = price
+	}
+	product.history.Record(product.ID, product.Current(), CauseAdmin)
+	product.publish(EventPrice)
+	return nil
+}
+
+// CheckBasePrice says whether SetBasePrice would take price.
+func (product *Product) CheckBasePrice(price int) error {
+	product.lock.RLock()
+	defer product.lock.RUnlock()
+
+	_, err := product.checkBasePrice(price)
+	return err
+}
+
+// checkBasePrice returns the floor the product would have at base price. It
+// must be called with the product lock held.
+func (product *Product) checkBasePrice(price int) (int, error) {
+	floor := priceFloor(price, product.lowRatio, product.CostPrice, product.minMargin)
+	if legal := product.legalFloor(); legal > floor {
+		floor = legal
+	}
+	ceiling := int(float64(price) * product.crashRatio)
+	if floor > ceiling {
+		return 0, fmt.Errorf("floor of %s is above the crash price of %s", product.money.Format(floor), product.money.Format(ceiling))
+	}
+	return floor, nil
+}
+
+// CheckPrice says whether SetPrice would take price.
+func (product *Product) CheckPrice(price int) error {
+	product.lock.RLock()
+	defer product.lock.RUnlock()
+
+	return product.checkPrice(price)
+}
+
+// checkPrice must be called with the product lock held.
+func (product *Product) checkPrice(price int) error {
+	if product.fixed {
+		return fmt.Errorf("dynamic pricing is off")
+	}
+	if price < product.minPrice() || price > product.maxPrice() {
+		return fmt.Errorf("price must be between %s and %s", product.money.Format(product.minPrice()), product.money.Format(product.maxPrice()))
+	}
+	return nil
+}
+
+// Freeze holds the price where it is. Sales, refunds, the clock and crashes
+// don't move a frozen price until it is unfrozen.
+func (product *Product) Freeze() {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	if product.frozen {
+		return
+	}
+	product.frozen = true
+	product.history.Record(product.ID, product.Current(), CauseFreeze)
+	product.publish(EventPrice)
+}
+
+// Unfreeze lets the price move again, a full clock period from now.
+func (product *Product) Unfreeze() {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	if !product.frozen {
+		return
+	}
+	product.frozen = false
+	product.scheduler.Reset(product)
+	product.history.Record(product.ID, product.Current(), CauseUnfreeze)
+	product.publish(EventPrice)
+}
+
+func (product *Product) Frozen() bool {
+	product.lock.RLock()
+	defer product.lock.RUnlock()
+
+	return product.frozen
+}
+
+// pinned says whether the price is being held, by staff or by a schedule,
+// where nothing in the market moves it. It must be called with the product
+// lock held.
+func (product *Product) pinned() bool {
+	return product.frozen || product.fixed
+}
+
+// ApplySchedule moves the product onto the pricing of the named schedule.
+// Without dynamic pricing the price sits at the base price. When dynamic
+// pricing comes back on the price opens at its floor, as a new product's
+// does, and a change of ratios keeps the price within the new range.
+func (product *Product) ApplySchedule(name string, dynamic bool) {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	if product.schedule == name && product.fixed == !dynamic {
+		return
+	}
+
+	wasFixed := product.fixed
+	product.schedule = name
+	product.fixed = !dynamic
+	product.usePriceSet()
+
+	price := product.currentPrice
+	switch {
+	case product.fixed:
+		price = product.clamp(product.BasePrice, CauseSchedule)
+	case wasFixed:
+		price = product.clamp(product.marketFloor(), CauseSchedule)
+	case price < product.minPrice():
+		price = product.clamp(price, CauseSchedule)
+	case price > product.maxPrice():
+		price = product.maxPrice()
+	}
+
+	session := product.fixed || wasFixed
+	if session {
+		// What happened in the last session doesn't carry over.
+		product.lowPrice = price
+		product.highPrice = price
+		product.Trend = ""
+		product.sales = 0
+		product.saleSteps = nil
+		product.holding = 0
+		product.scheduler.Reset(product)
+	}
+	if price == product.currentPrice && !session {
+		return
+	}
+
+	if price < product.lowPrice {
+		product.lowPrice = price
+	}
+	if price > product.highPrice {
+		product.highPrice = price
+	}
+	product.currentPrice = price
+	product.history.Record(product.ID, product.Current(), CauseSchedule)
+	product.publish(EventPrice)
+}
+
+// usePriceSet switches to the ratios and strategy of the product's schedule.
+// It must be called with the product lock held.
+func (product *Product) usePriceSet() {
+	set, ok := product.priceSets[product.schedule]
+	if !ok {
+		set, ok = product.priceSets[""]
+	}
+	if !ok {
+		return
+	}
+
+	product.lowRatio = set.LowRatio
+	product.crashRatio = set.CrashRatio
+	product.strategy = set.Strategy
+}
+
+// minPrice is the lowest the price can go, the market's floor or the legal
+// minimum if that is higher.
 func (product *Product) minPrice() int {
-	return int(float64(product.BasePrice) * LowRatio)
+	floor := product.marketFloor()
+	if legal := product.legalFloor(); legal > floor {
+		return legal
+	}
+	return floor
+}
+
+// marketFloor is the floor the market would price down to by its ratios and
+// margins alone, which pricing strategies work to.
+func (product *Product) marketFloor() int {
+	return priceFloor(product.BasePrice, product.lowRatio, product.CostPrice, product.minMargin)
+}
+
+// priceFloor is the lowest a price can go: its share of the base price, or
+// the cost price plus the minimum margin if that is higher.
+func priceFloor(basePrice int, lowRatio float64, costPrice, minMargin int) int {
+	floor := int(float64(basePrice) * lowRatio)
+	if costPrice > 0 && costPrice+minMargin > floor {
+		floor = costPrice + minMargin
+	}
+	return floor
 }
 
 func (product *Product) maxPrice() int {
-	return int(float64(product.BasePrice) * CrashRatio)
+	return int(float64(product.BasePrice) * product.crashRatio)
+}
+
+func (product *Product) priceState() PriceState {
+	return PriceState{
+		BasePrice: product.BasePrice,
+		Current:   product.currentPrice,
+		Min:       product.marketFloor(),
+		Max:       product.maxPrice(),
+		Sales:     product.sales,
+	}
 }
 
 func (product *Product) IncrPrice() {
 	product.lock.Lock()
 	defer product.lock.Unlock()
 
-	product.reset <- struct{}{}
+	if product.pinned() {
+		return
+	}
+
+	now := product.clock.Now()
+	if product.holding > 0 || now.Before(product.cooldownEnds) {
+		// The product crashed recently, so sales don't move it yet.
+		return
+	}
 
-	newPrice := int(math.Ceil(float64(product.currentPrice) * (1.0 + PriceIncrement)))
+	product.scheduler.Reset(product)
+
+	state := product.priceState()
+	product.sales++
+
+	newPrice := product.strategy.OnSale(state)
 
 	if (newPrice > product.maxPrice()) {
-		product.currentPrice = product.minPrice()
-		crash.lock.Lock()
-		crash.ID = &product.ID
-		crash.lock.Unlock()
-
-		go func() {
-			select {
-			case <-time.After(2 * time.Second):
-				crash.lock.Lock()
-				if *crash.ID == product.ID {
-					crash.ID = nil
-				}
-				crash.lock.Unlock()
-			}
-		}()
-		product.Trend = TrendDown
+		product.crashPrice(state, now, CrashProduct, "")
 		return
 	}
 
+	product.saleSteps = append(product.saleSteps, newPrice-product.currentPrice)
+	if len(product.saleSteps) > maxSaleSteps {
+		product.saleSteps = product.saleSteps[1:]
+	}
+
 	product.currentPrice = newPrice
 	product.Trend = TrendUp
 
 	if product.currentPrice > product.highPrice {
 		product.highPrice = product.currentPrice
 	}
+	product.history.Record(product.ID, product.Current(), CauseSale)
+	product.publish(EventPrice)
 }
 
-func (product *Product) DecrPrice() {
+// ForceCrash crashes the product whatever its price, as part of a crash of
+// type crashType across category. A frozen product, or one whose price is
+// fixed by a schedule, doesn't crash.
+func (product *Product) ForceCrash(crashType, category string) (Crash, error) {
 	product.lock.Lock()
 	defer product.lock.Unlock()
 
-	newPrice := int(math.Floor(float64(product.currentPrice) * (1 - PriceIncrement)))
+	err := product.checkCrash()
+	if err != nil {
+		return Crash{}, err
+	}
 
-	minPrice := product.minPrice()
-	if newPrice < minPrice {
-		product.currentPrice = product.minPrice()
-		product.Trend = ""
+	return product.crashPrice(product.priceState(), product.clock.Now(), crashType, category), nil
+}
+
+// CheckCrash says whether ForceCrash would crash the product.
+func (product *Product) CheckCrash() error {
+	product.lock.RLock()
+	defer product.lock.RUnlock()
+
+	return product.checkCrash()
+}
+
+// checkCrash must be called with the product lock held.
+func (product *Product) checkCrash() error {
+	if product.frozen {
+		return fmt.Errorf("product %d is frozen", product.ID)
+	}
+	if product.fixed {
+		return fmt.Errorf("dynamic pricing is off")
+	}
+	return nil
+}
+
+// crashPrice must be called with the product lock held.
+func (product *Product) crashPrice(state PriceState, now time.Time, crashType, category string) Crash {
+	price := product.strategy.OnCrash(state)
+	if product.crashHold > 0 {
+		price = product.marketFloor()
+		product.holding = product.crashHold
+	}
+	product.currentPrice = product.clamp(price, CauseCrash)
+	product.cooldownEnds = now.Add(product.cooldown)
+	product.sales = 0
+	product.saleSteps = nil
+	crash := product.crash.Start(Crash{
+		Type:        crashType,
+		Category:    category,
+		ProductID:   product.ID,
+		Time:        now,
+		Ends:        now.Add(product.crashWindow),
+		PriceBefore: product.shown(state.Current),
+		PriceAfter:  product.Current(),
+	})
+	product.crash.EndAfter(crash.ID, product.clock.After(product.crashWindow))
+	product.Trend = TrendDown
+	product.history.Record(product.ID, product.Current(), CauseCrash)
+	product.publish(EventPrice)
+	product.publishCrash(crash)
+	return crash
+}
+
+// ReversePrice backs out a sale that was voided or refunded. A sale that
+// crashed the price can't be taken back, the crash has already happened.
+func (product *Product) ReversePrice() {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	if product.pinned() {
+		return
+	}
+
+	if product.sales > 0 {
+		product.sales--
+	}
+
+	var newPrice int
+	switch product.refundMode {
+	case RefundTick:
+		newPrice = product.strategy.OnTick(product.priceState())
+	default:
+		if len(product.saleSteps) == 0 {
+			return
+		}
+		last := len(product.saleSteps) - 1
+		newPrice = product.currentPrice - product.saleSteps[last]
+		product.saleSteps = product.saleSteps[:last]
+	}
+
+	newPrice = product.clamp(newPrice, CauseRefund)
+	if newPrice == product.currentPrice {
 		return
 	}
 
 	product.currentPrice = newPrice
 	product.Trend = TrendDown
+	product.history.Record(product.ID, product.Current(), CauseRefund)
+	product.publish(EventPrice)
 }
 
-func (menu Menu) Product(productID int) (*Product, error) {
-	for _, product := range menu.Items {
-		if product.ID == productID {
-			return product, nil
-		}
+func (product *Product) DecrPrice() {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	if product.pinned() {
+		return
+	}
+
+	if product.holding > 0 {
+		product.holding--
+		return
+	}
+
+	state := product.priceState()
+	product.sales = 0
+
+	newPrice := product.strategy.OnTick(state)
+
+	// A price that has reached its floor stops trending.
+	trend := TrendDown
+	if newPrice <= product.minPrice() {
+		newPrice = product.clamp(newPrice, CauseTick)
+		trend = ""
 	}
 
-	return nil, fmt.Errorf("product %d not found", productID)
+	changed := product.currentPrice != newPrice || product.Trend != trend
+	product.currentPrice = newPrice
+	product.Trend = trend
+	if changed {
+		product.history.Record(product.ID, product.Current(), CauseTick)
+		product.publish(EventPrice)
+	}
+}
+
+// publish must be called with the product lock held.
+func (product *Product) publish(eventType string) {
+	price := newPriceResp(product, product.money)
+	product.events.Publish(MarketEvent{
+		Type:      eventType,
+		ProductID: product.ID,
+		Price:     &price,
+	})
 }
 
-func newPriceResp(product Product) priceResponse {
+func (product *Product) publishCrash(crash Crash) {
+	price := newPriceResp(product, product.money)
+	crashResp := newCrashResp(crash, product.money)
+	product.events.Publish(MarketEvent{
+		Type:      EventCrash,
+		ProductID: product.ID,
+		Price:     &price,
+		Crash:     &crashResp,
+	})
+}
+
+func newPriceResp(product *Product, money Money) priceResponse {
 	return priceResponse{
-		ID:      product.ID,
-		Low:     toMoney(product.Low()),
-		High:    toMoney(product.High()),
-		Current: toMoney(product.Current()),
-		Trend:   product.Trend,
+		ID:           product.ID,
+		Low:          money.Format(product.Low()),
+		High:         money.Format(product.High()),
+		Current:      money.Format(product.Current()),
+		LowMinor:     product.Low(),
+		HighMinor:    product.High(),
+		CurrentMinor: product.Current(),
+		Trend:        product.Trend,
+		Frozen:       product.frozen,
 	}
 }
 
-func (product Product) Current() int {
-	return product.currentPrice
+// Current is the price the product is shown and charged at.
+func (product *Product) Current() int {
+	return product.shown(product.currentPrice)
 }
 
-func (product Product) High() int {
-	return product.highPrice
+func (product *Product) High() int {
+	return product.shown(product.highPrice)
 }
 
-func (product Product) Low() int {
-	return product.lowPrice
+func (product *Product) Low() int {
+	return product.shown(product.lowPrice)
 }
 
-func toMoney(amount int) string {
-	return fmt.Sprintf("£%.2f", float64(amount)/100.0)
+// shown rounds a market price for the board. Fixed prices are the bar's own
+// and are shown as they are.
+func (product *Product) shown(price int) int {
+	if product.fixed {
+		return price
+	}
+	return product.rounding.Round(price, product.minPrice())
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Market is one venue: its menu, the state its prices share and the
+// configuration new products are made from.
+type Market struct {
+	LocationID int
+	Name       string
+	Config     Config
+	Menu       *Menu
+}
+
+// Markets holds every venue a deployment serves. Bills from a location that
+// isn't listed go to the default market, if there is one.
+type Markets struct {
+	Default    *Market
+	ByLocation map[int]*Market
+	Log        *EventLog
+	Clock      Clock
+}
+
+func NewMarket(locationID int, name string, config Config, log *EventLog, clock Clock) (*Market, error) {
+	menu, err := config.menu(locationID, log, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Market{
+		LocationID: locationID,
+		Name:       name,
+		Config:     config,
+		Menu:       menu,
+	}, nil
+}
+
+// Markets builds a market for each location in the configuration, and a
+// default market from the top-level products.
+func (config Config) Markets() (*Markets, error) {
+	return config.MarketsOn(RealClock())
+}
+
+// MarketsOn builds the markets to run on clock.
+func (config Config) MarketsOn(clock Clock) (*Markets, error) {
+	markets := &Markets{ByLocation: map[int]*Market{}, Log: NewEventLog(), Clock: clock}
+
+	if len(config.Products) > 0 {
+		market, err := NewMarket(0, "", config, markets.Log, clock)
+		if err != nil {
+			return nil, err
+		}
+		markets.Default = market
+	}
+
+	for _, location := range config.Locations {
+		resolved, err := config.Location(location)
+		if err != nil {
+			return nil, fmt.Errorf("location %d: %s", location.ID, err)
+		}
+
+		market, err := NewMarket(location.ID, location.Name, resolved, markets.Log, clock)
+		if err != nil {
+			return nil, fmt.Errorf("location %d: %s", location.ID, err)
+		}
+		markets.ByLocation[location.ID] = market
+	}
+
+	return markets, nil
+}
+
+// For finds the market bills from a location belong to.
+func (markets *Markets) For(locationID int) *Market {
+	if market, ok := markets.ByLocation[locationID]; ok {
+		return market
+	}
+	return markets.Default
+}
+
+// Location finds the market at locationID, where 0 is the default market.
+func (markets *Markets) Location(locationID int) *Market {
+	if locationID == 0 {
+		return markets.Default
+	}
+	return markets.ByLocation[locationID]
+}
+
+// All lists the default market first, then locations in order.
+func (markets *Markets) All() []*Market {
+	var all []*Market
+	if markets.Default != nil {
+		all = append(all, markets.Default)
+	}
+
+	var locationIDs []int
+	for locationID := range markets.ByLocation {
+		locationIDs = append(locationIDs, locationID)
+	}
+	sort.Ints(locationIDs)
+	for _, locationID := range locationIDs {
+		all = append(all, markets.ByLocation[locationID])
+	}
+
+	return all
+}
+
+// Start starts ticking every market's prices and following its schedules.
+func (markets *Markets) Start() {
+	for _, market := range markets.All() {
+		market.Menu.Scheduler.Start()
+		market.Menu.Timetable.Start(market.Menu.followSchedule)
+	}
+}
+
+// Stop stops ticking every market's prices and following its schedules,
+// waiting for changes in progress.
+func (markets *Markets) Stop() {
+	for _, market := range markets.All() {
+		market.Menu.Timetable.Stop()
+		market.Menu.Scheduler.Stop()
+	}
+}
+
+type marketHandler func(w http.ResponseWriter, r *http.Request, market *Market)
+
+// withMarket resolves the market a request is for: the location in the path
+// under /locations/{location}, otherwise the default market.
+func withMarket(handler marketHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		market := markets.Default
+
+		if location, ok := mux.Vars(r)["location"]; ok {
+			locationID, _ := strconv.Atoi(location)
+			market = markets.ByLocation[locationID]
+			if market == nil {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(fmt.Sprintf("location %d not found", locationID)))
+				return
+			}
+		}
+
+		if market == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no default market, use /locations/{id}"))
+			return
+		}
+
+		handler(w, r, market)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+type Menu struct {
+	LocationID int
+	Items      []*Product
+	Retired    []*Product
+	Events     *Broker
+	History    *History
+	Bills      *BillLedger
+	Crash      *CrashState
+	Demand     *Demand
+	Compliance *Compliance
+	Log        *EventLog
+	Clock      Clock
+	Scheduler  *Scheduler
+	Timetable  *Timetable
+	Money      Money
+	schedule   *Schedule
+	lock       sync.RWMutex
+}
+
+// Products returns the products currently on sale.
+func (menu *Menu) Products() []*Product {
+	menu.lock.RLock()
+	defer menu.lock.RUnlock()
+
+	products := make([]*Product, len(menu.Items))
+	copy(products, menu.Items)
+	return products
+}
+
+// RetiredProducts returns the products taken off sale.
+func (menu *Menu) RetiredProducts() []*Product {
+	menu.lock.RLock()
+	defer menu.lock.RUnlock()
+
+	products := make([]*Product, len(menu.Retired))
+	copy(products, menu.Retired)
+	return products
+}
+
+func (menu *Menu) Product(productID int) (*Product, error) {
+	menu.lock.RLock()
+	defer menu.lock.RUnlock()
+
+	for _, product := range menu.Items {
+		if product.ID == productID {
+			return product, nil
+		}
+	}
+
+	return nil, fmt.Errorf("product %d not found", productID)
+}
+
+// Lookup finds a product whether it is on sale or retired.
+func (menu *Menu) Lookup(productID int) (*Product, error) {
+	menu.lock.RLock()
+	defer menu.lock.RUnlock()
+
+	for _, products := range [][]*Product{menu.Items, menu.Retired} {
+		for _, product := range products {
+			if product.ID == productID {
+				return product, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("product %d not found", productID)
+}
+
+// ProductOptions connects a new product to the menu's event broker, price
+// history, crash state, compliance report, event log, clock, scheduler and
+// currency.
+func (menu *Menu) ProductOptions() []ProductOption {
+	return []ProductOption{
+		WithBroker(menu.Events),
+		WithHistory(menu.History),
+		WithCrash(menu.Crash),
+		WithCompliance(menu.Compliance),
+		WithEventLog(menu.Log, menu.LocationID),
+		WithClock(menu.Clock),
+		WithScheduler(menu.Scheduler),
+		WithMoney(menu.Money),
+	}
+}
+
+// Add puts a product on sale, on the pricing of the schedule the menu is
+// following. Product IDs can't be reused, even by a product that has been
+// retired, so its price history stays unambiguous.
+func (menu *Menu) Add(product *Product) error {
+	_, err := menu.Create(product.ID, func() *Product { return product })
+	return err
+}
+
+// Create puts the product build makes on sale as productID. Nothing is built
+// for an ID that is taken, so the product that has it keeps its history.
+func (menu *Menu) Create(productID int, build func() *Product) (*Product, error) {
+	menu.lock.Lock()
+	if menu.hasID(productID) {
+		menu.lock.Unlock()
+		return nil, fmt.Errorf("product %d already exists", productID)
+	}
+	product := build()
+	menu.Items = append(menu.Items, product)
+	schedule := menu.schedule
+	product.lock.RLock()
+	product.publish(EventAdded)
+	product.lock.RUnlock()
+	menu.lock.Unlock()
+
+	if schedule != nil {
+		product.ApplySchedule(schedule.Name, schedule.Dynamic)
+	}
+	return product, nil
+}
+
+// NextID is the lowest ID above every product the menu has ever had.
+func (menu *Menu) NextID() int {
+	menu.lock.RLock()
+	defer menu.lock.RUnlock()
+
+	next := 1
+	for _, products := range [][]*Product{menu.Items, menu.Retired} {
+		for _, product := range products {
+			if product.ID >= next {
+				next = product.ID + 1
+			}
+		}
+	}
+	return next
+}
+
+// Retire takes a product off sale and stops its clock. The product is kept so
+// its prices can still be looked up.
+func (menu *Menu) Retire(productID int) (*Product, error) {
+	menu.lock.Lock()
+	defer menu.lock.Unlock()
+
+	for i, product := range menu.Items {
+		if product.ID == productID {
+			menu.Items = append(menu.Items[:i:i], menu.Items[i+1:]...)
+			menu.Retired = append(menu.Retired, product)
+			product.Stop()
+			product.lock.RLock()
+			product.publish(EventRetired)
+			product.lock.RUnlock()
+			return product, nil
+		}
+	}
+
+	return nil, fmt.Errorf("product %d not found", productID)
+}
+
+// hasID must be called with the menu lock held.
+func (menu *Menu) hasID(productID int) bool {
+	for _, products := range [][]*Product{menu.Items, menu.Retired} {
+		for _, product := range products {
+			if product.ID == productID {
+				return true
+			}
+		}
+	}
+	return false
+}
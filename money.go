@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Currency is what a market prices in. Prices are whole numbers of its minor
+// unit, pence for pounds.
+type Currency struct {
+	Code   string
+	Symbol string
+	Digits int
+}
+
+// DefaultCurrency is the currency of a market that doesn't set one.
+const DefaultCurrency = "GBP"
+
+var currencies = map[string]Currency{
+	"GBP": {Code: "GBP", Symbol: "£", Digits: 2},
+	"EUR": {Code: "EUR", Symbol: "€", Digits: 2},
+	"USD": {Code: "USD", Symbol: "$", Digits: 2},
+	"JPY": {Code: "JPY", Symbol: "¥", Digits: 0},
+}
+
+// moneyFormat is how a locale writes an amount of money: the separators
+// around its digits, and which side of them the symbol goes on with what gap.
+type moneyFormat struct {
+	decimal     string
+	group       string
+	symbolAfter bool
+	gap         string
+}
+
+// locales are the languages money can be written in, British English first
+// as the default, and localeFormats how each of them writes it.
+var locales = []language.Tag{
+	language.BritishEnglish,
+	language.AmericanEnglish,
+	language.German,
+	language.French,
+	language.Spanish,
+	language.Italian,
+	language.Dutch,
+	language.Japanese,
+}
+
+var localeFormats = []moneyFormat{
+	{decimal: ".", group: ","},
+	{decimal: ".", group: ","},
+	{decimal: ",", group: ".", symbolAfter: true, gap: "\u00a0"},
+	{decimal: ",", group: "\u202f", symbolAfter: true, gap: "\u00a0"},
+	{decimal: ",", group: ".", symbolAfter: true, gap: "\u00a0"},
+	{decimal: ",", group: ".", symbolAfter: true, gap: "\u00a0"},
+	{decimal: ",", group: ".", gap: "\u00a0"},
+	{decimal: ".", group: ","},
+}
+
+var localeMatcher = language.NewMatcher(locales)
+
+var defaultMoney = NewMoney(currencies[DefaultCurrency], language.BritishEnglish)
+
+// Money writes amounts in a market's currency the way its locale does. The
+// zero Money writes pounds in British English.
+type Money struct {
+	Currency Currency
+	Locale   language.Tag
+	format   moneyFormat
+}
+
+// NewMoney writes currency in the closest locale to locale there is.
+func NewMoney(currency Currency, locale language.Tag) Money {
+	_, index, _ := localeMatcher.Match(locale)
+	return Money{Currency: currency, Locale: locales[index], format: localeFormats[index]}
+}
+
+// ForLanguage writes the same currency in the locale that best matches an
+// Accept-Language header, or as before if none does.
+func (money Money) ForLanguage(accept string) Money {
+	if money.Currency.Code == "" {
+		money = defaultMoney
+	}
+
+	desired, _, err := language.ParseAcceptLanguage(accept)
+	if err != nil || len(desired) == 0 {
+		return money
+	}
+	_, index, confidence := localeMatcher.Match(desired...)
+	if confidence < language.High {
+		return money
+	}
+	return Money{Currency: money.Currency, Locale: locales[index], format: localeFormats[index]}
+}
+
+// Code is the ISO 4217 code of the currency.
+func (money Money) Code() string {
+	if money.Currency.Code == "" {
+		return defaultMoney.Currency.Code
+	}
+	return money.Currency.Code
+}
+
+// Format writes amount, in the currency's minor unit, as money.
+func (money Money) Format(amount int) string {
+	if money.Currency.Code == "" {
+		money = defaultMoney
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	unit := money.unit()
+	number := groupDigits(strconv.Itoa(amount/unit), money.format.group)
+	if money.Currency.Digits > 0 {
+		number += money.format.decimal + fmt.Sprintf("%0*d", money.Currency.Digits, amount%unit)
+	}
+
+	if money.format.symbolAfter {
+		return sign + number + money.format.gap + money.Currency.Symbol
+	}
+	return sign + money.Currency.Symbol + money.format.gap + number
+}
+
+// Minor turns an amount in whole units of the currency, as POS systems send
+// prices, into its minor unit.
+func (money Money) Minor(amount float64) int {
+	if money.Currency.Code == "" {
+		money = defaultMoney
+	}
+	return int(math.Round(amount * float64(money.unit())))
+}
+
+// unit is how many of the currency's minor unit make one whole unit.
+func (money Money) unit() int {
+	unit := 1
+	for i := 0; i < money.Currency.Digits; i++ {
+		unit *= 10
+	}
+	return unit
+}
+
+// groupDigits separates the thousands of a whole number.
+func groupDigits(digits, separator string) string {
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteString(separator)
+		}
+		grouped.WriteRune(digit)
+	}
+	return grouped.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import "fmt"
+
+const (
+	RoundingNone    = "none"
+	RoundingNearest = "nearest"
+	RoundingCharm   = "charm"
+)
+
+// How a price exactly halfway between two menu-friendly amounts rounds: up,
+// or to whichever is an even number of steps (banker's rounding).
+const (
+	TiesHalfUp   = "half_up"
+	TiesHalfEven = "half_even"
+)
+
+// CharmStep is how far apart charm prices are when the configuration doesn't
+// say, so they end in 9p.
+const CharmStep = 10
+
+// RoundingConfig selects how prices are rounded for the board and the till.
+// Nearest rounds to a multiple of step pence; charm rounds to a price one
+// penny under a multiple of step.
+type RoundingConfig struct {
+	Type string `yaml:"type"`
+	Step int    `yaml:"step"`
+	Ties string `yaml:"ties"`
+}
+
+func (config RoundingConfig) validate() error {
+	switch config.Type {
+	case "", RoundingNone:
+		return nil
+	case RoundingNearest:
+		if config.Step <= 0 {
+			return fmt.Errorf("nearest rounding needs a positive step")
+		}
+	case RoundingCharm:
+		if config.Step < 0 {
+			return fmt.Errorf("charm rounding needs a positive step")
+		}
+	default:
+		return fmt.Errorf("unknown rounding %q", config.Type)
+	}
+
+	switch config.Ties {
+	case "", TiesHalfUp, TiesHalfEven:
+		return nil
+	default:
+		return fmt.Errorf("rounding ties must be %q or %q", TiesHalfUp, TiesHalfEven)
+	}
+}
+
+func (config RoundingConfig) Rounding() Rounding {
+	rounding := Rounding{Step: config.Step, HalfEven: config.Ties == TiesHalfEven}
+	switch config.Type {
+	case RoundingNearest:
+	case RoundingCharm:
+		if rounding.Step == 0 {
+			rounding.Step = CharmStep
+		}
+		rounding.Offset = -1
+	default:
+		return Rounding{}
+	}
+	return rounding
+}
+
+// Rounding turns a product's price into the amount shown and charged: the
+// nearest multiple of Step, shifted by Offset. The zero Rounding leaves
+// prices as they are.
+type Rounding struct {
+	Step     int
+	Offset   int
+	HalfEven bool
+}
+
+// Round rounds price, never to below floor.
+func (rounding Rounding) Round(price, floor int) int {
+	if rounding.Step <= 0 {
+		return price
+	}
+
+	steps, rest := rounding.split(price)
+	switch {
+	case 2*rest > rounding.Step:
+		steps++
+	case 2*rest == rounding.Step && (!rounding.HalfEven || steps%2 != 0):
+		steps++
+	}
+
+	rounded := steps*rounding.Step + rounding.Offset
+	if rounded < floor || rounded <= 0 {
+		return rounding.up(floor)
+	}
+	return rounded
+}
+
+// up is the lowest rounded price no lower than price.
+func (rounding Rounding) up(price int) int {
+	if price < 1 {
+		price = 1
+	}
+
+	steps, rest := rounding.split(price)
+	if rest > 0 {
+		steps++
+	}
+	return steps*rounding.Step + rounding.Offset
+}
+
+func (rounding Rounding) split(price int) (int, int) {
+	shifted := price - rounding.Offset
+	return shifted / rounding.Step, shifted % rounding.Step
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleConfig is a window of the week, such as a happy hour, that changes
+// how a market prices. Days default to every day, and a window that ends
+// before it starts runs past midnight into the next day. Ratios given here
+// replace the market's while the schedule is active.
+type ScheduleConfig struct {
+	Name           string   `yaml:"name"`
+	Days           []string `yaml:"days"`
+	Start          string   `yaml:"start"`
+	End            string   `yaml:"end"`
+	Dynamic        *bool    `yaml:"dynamic"`
+	LowRatio       *float64 `yaml:"low_ratio"`
+	CrashRatio     *float64 `yaml:"crash_ratio"`
+	PriceIncrement *float64 `yaml:"price_increment"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// Schedule is a parsed ScheduleConfig. Outside every schedule a market's
+// prices are fixed, which the zero Schedule stands for.
+type Schedule struct {
+	Name    string
+	Days    [7]bool
+	Start   time.Duration
+	End     time.Duration
+	Dynamic bool
+}
+
+func (config ScheduleConfig) Schedule() (Schedule, error) {
+	schedule := Schedule{Name: config.Name, Dynamic: true}
+	if strings.TrimSpace(config.Name) == "" {
+		return Schedule{}, fmt.Errorf("name is required")
+	}
+	if config.Dynamic != nil {
+		schedule.Dynamic = *config.Dynamic
+	}
+
+	for _, day := range config.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return Schedule{}, fmt.Errorf("unknown day %q", day)
+		}
+		schedule.Days[weekday] = true
+	}
+	if len(config.Days) == 0 {
+		schedule.Days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	var err error
+	schedule.Start, err = timeOfDay(config.Start)
+	if err != nil {
+		return Schedule{}, fmt.Errorf("start: %s", err)
+	}
+	schedule.End, err = timeOfDay(config.End)
+	if err != nil {
+		return Schedule{}, fmt.Errorf("end: %s", err)
+	}
+	if schedule.Start == schedule.End {
+		return Schedule{}, fmt.Errorf("start and end must differ")
+	}
+
+	return schedule, nil
+}
+
+// timeOfDay parses a 24-hour "HH:MM" time into how long after midnight it is.
+func timeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time like 17:30", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// covers says whether the schedule is active on weekday at time of day tod.
+func (schedule Schedule) covers(weekday time.Weekday, tod time.Duration) bool {
+	if schedule.Start < schedule.End {
+		return schedule.Days[weekday] && tod >= schedule.Start && tod < schedule.End
+	}
+
+	yesterday := (weekday + 6) % 7
+	return (schedule.Days[weekday] && tod >= schedule.Start) || (schedule.Days[yesterday] && tod < schedule.End)
+}
+
+// PriceSet is the ratios and strategy a product prices by while a schedule
+// is active.
+type PriceSet struct {
+	LowRatio   float64
+	CrashRatio float64
+	Strategy   PricingStrategy
+}
+
+// Timetable switches a market between its schedules as the week goes by, in
+// the venue's time zone. When schedules overlap the first listed wins. A
+// market without schedules prices dynamically all the time.
+type Timetable struct {
+	schedules []Schedule
+	location  *time.Location
+	clock     Clock
+	lock      sync.Mutex
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+func NewTimetable(schedules []Schedule, location *time.Location, clock Clock) *Timetable {
+	return &Timetable{schedules: schedules, location: location, clock: clock}
+}
+
+// Enabled says whether the market follows any schedules.
+func (timetable *Timetable) Enabled() bool {
+	return timetable != nil && len(timetable.schedules) > 0
+}
+
+// Location is the venue's time zone, the server's for a menu without a
+// timetable.
+func (timetable *Timetable) Location() *time.Location {
+	if timetable == nil {
+		return time.Local
+	}
+	return timetable.location
+}
+
+// Lookup finds a schedule by name. The empty name is the zero Schedule, in
+// force outside every schedule.
+func (timetable *Timetable) Lookup(name string) (Schedule, bool) {
+	if name == "" {
+		return Schedule{}, true
+	}
+	for _, schedule := range timetable.schedules {
+		if schedule.Name == name {
+			return schedule, true
+		}
+	}
+	return Schedule{}, false
+}
+
+func (timetable *Timetable) active(t time.Time) Schedule {
+	local := t.In(timetable.location)
+	tod := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+
+	for _, schedule := range timetable.schedules {
+		if schedule.covers(local.Weekday(), tod) {
+			return schedule
+		}
+	}
+	return Schedule{}
+}
+
+// At is the schedule active at t and when it next changes. There is no next
+// change for a market without schedules.
+func (timetable *Timetable) At(t time.Time) (Schedule, time.Time, bool) {
+	active := timetable.active(t)
+
+	// Schedules only change where one starts or ends, so look at those over
+	// the coming week for the first where a different schedule is active.
+	local := t.In(timetable.location)
+	var boundaries []time.Time
+	for day := -1; day <= 8; day++ {
+		for _, schedule := range timetable.schedules {
+			for _, offset := range []time.Duration{schedule.Start, schedule.End} {
+				boundary := time.Date(local.Year(), local.Month(), local.Day()+day,
+					int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, timetable.location)
+				if boundary.After(t) {
+					boundaries = append(boundaries, boundary)
+				}
+			}
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].Before(boundaries[j]) })
+
+	for _, boundary := range boundaries {
+		if timetable.active(boundary) != active {
+			return active, boundary, true
+		}
+	}
+	return active, time.Time{}, false
+}
+
+// Start calls follow with the active schedule now and every time it changes.
+// A timetable without schedules doesn't start.
+func (timetable *Timetable) Start(follow func(Schedule)) {
+	if !timetable.Enabled() {
+		return
+	}
+
+	timetable.lock.Lock()
+	defer timetable.lock.Unlock()
+
+	if timetable.quit != nil {
+		return
+	}
+
+	timetable.quit = make(chan struct{})
+	timetable.done = make(chan struct{})
+	go timetable.run(follow, timetable.quit, timetable.done)
+}
+
+// Stop stops following the schedules and waits for a change in progress.
+func (timetable *Timetable) Stop() {
+	if timetable == nil {
+		return
+	}
+
+	timetable.lock.Lock()
+	quit, done := timetable.quit, timetable.done
+	timetable.quit, timetable.done = nil, nil
+	timetable.lock.Unlock()
+
+	if quit == nil {
+		return
+	}
+
+	close(quit)
+	<-done
+}
+
+func (timetable *Timetable) run(follow func(Schedule), quit, done chan struct{}) {
+	defer close(done)
+
+	for {
+		now := timetable.clock.Now()
+		active, next, ok := timetable.At(now)
+		follow(active)
+
+		var timer Timer
+		var fired <-chan time.Time
+		if ok {
+			timer = timetable.clock.NewTimer(next.Sub(now))
+			fired = timer.C()
+		}
+
+		select {
+		case <-fired:
+		case <-quit:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+
+		timer.Stop()
+	}
+}
+
+// ApplySchedule moves every product on sale onto schedule's pricing.
+// Products added later follow it too.
+func (menu *Menu) ApplySchedule(schedule Schedule) {
+	menu.lock.Lock()
+	menu.schedule = &schedule
+	menu.lock.Unlock()
+
+	for _, product := range menu.Products() {
+		product.ApplySchedule(schedule.Name, schedule.Dynamic)
+	}
+}
+
+// Schedule is the schedule the menu's prices are following, if any.
+func (menu *Menu) Schedule() (Schedule, bool) {
+	menu.lock.RLock()
+	defer menu.lock.RUnlock()
+
+	if menu.schedule == nil {
+		return Schedule{}, false
+	}
+	return *menu.schedule, true
+}
+
+// followSchedule logs and applies a change of schedule.
+func (menu *Menu) followSchedule(schedule Schedule) {
+	if current, ok := menu.Schedule(); ok && current == schedule {
+		return
+	}
+
+	entry := LogEntry{Type: LogSchedule, LocationID: menu.LocationID, Schedule: schedule.Name}
+	menu.Log.Record(entry, func() {
+		menu.ApplySchedule(schedule)
+	})
+}
+
+type scheduleResponse struct {
+	Active     string     `json:"active,omitempty"`
+	Dynamic    bool       `json:"dynamic"`
+	NextChange *time.Time `json:"nextChange,omitempty"`
+}
+
+func newScheduleResp(timetable *Timetable, now time.Time) *scheduleResponse {
+	if !timetable.Enabled() {
+		return nil
+	}
+
+	active, next, ok := timetable.At(now)
+	response := &scheduleResponse{Active: active.Name, Dynamic: active.Dynamic}
+	if ok {
+		response.NextChange = &next
+	}
+	return response
+}
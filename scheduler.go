@@ -0,0 +1,267 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Scheduler ticks the prices of a market's products down. Each product ticks
+// once its clock period has passed without a sale or a tick. A single
+// goroutine waits for whichever product is due next, however many products
+// there are.
+type Scheduler struct {
+	clock  Clock
+	lock   sync.Mutex
+	queue  tickQueue
+	ticks  map[*Product]*scheduledTick
+	wake   chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+	paused time.Time
+}
+
+type scheduledTick struct {
+	product *Product
+	due     time.Time
+	index   int
+}
+
+// tickQueue is a heap of ticks, soonest first.
+type tickQueue []*scheduledTick
+
+func NewScheduler(clock Clock) *Scheduler {
+	return &Scheduler{
+		clock: clock,
+		ticks: map[*Product]*scheduledTick{},
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Add schedules the product's first tick a clock period from now.
+func (scheduler *Scheduler) Add(product *Product) {
+	if scheduler == nil {
+		return
+	}
+
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	if _, ok := scheduler.ticks[product]; ok {
+		return
+	}
+
+	tick := &scheduledTick{product: product, due: scheduler.clock.Now().Add(product.clockPeriod)}
+	heap.Push(&scheduler.queue, tick)
+	scheduler.ticks[product] = tick
+	scheduler.poke()
+}
+
+// Reset puts the product's next tick back to a clock period from now, as
+// happens when it sells.
+func (scheduler *Scheduler) Reset(product *Product) {
+	if scheduler == nil {
+		return
+	}
+
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	tick, ok := scheduler.ticks[product]
+	if !ok {
+		return
+	}
+
+	tick.due = scheduler.clock.Now().Add(product.clockPeriod)
+	heap.Fix(&scheduler.queue, tick.index)
+	scheduler.poke()
+}
+
+// Remove stops ticking the product.
+func (scheduler *Scheduler) Remove(product *Product) {
+	if scheduler == nil {
+		return
+	}
+
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	tick, ok := scheduler.ticks[product]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&scheduler.queue, tick.index)
+	delete(scheduler.ticks, product)
+	scheduler.poke()
+}
+
+// Len is how many products are scheduled.
+func (scheduler *Scheduler) Len() int {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	return len(scheduler.queue)
+}
+
+// Start begins ticking products. Products can be added before the scheduler
+// starts, but don't tick until it does.
+func (scheduler *Scheduler) Start() {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	if scheduler.quit != nil {
+		return
+	}
+
+	scheduler.quit = make(chan struct{})
+	scheduler.done = make(chan struct{})
+	go scheduler.run(scheduler.quit, scheduler.done)
+}
+
+// Pause holds every product's price where it is until Resume.
+func (scheduler *Scheduler) Pause() {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	if !scheduler.paused.IsZero() {
+		return
+	}
+
+	scheduler.paused = scheduler.clock.Now()
+	scheduler.poke()
+}
+
+// Resume carries on ticking after a pause. Each product gets the rest of the
+// clock period it had left when the scheduler paused.
+func (scheduler *Scheduler) Resume() {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	if scheduler.paused.IsZero() {
+		return
+	}
+
+	pause := scheduler.clock.Now().Sub(scheduler.paused)
+	for _, tick := range scheduler.queue {
+		tick.due = tick.due.Add(pause)
+	}
+	scheduler.paused = time.Time{}
+	scheduler.poke()
+}
+
+// Paused reports whether the scheduler is paused.
+func (scheduler *Scheduler) Paused() bool {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	return !scheduler.paused.IsZero()
+}
+
+// Stop stops ticking and waits for any tick in progress to finish. A stopped
+// scheduler can be started again.
+func (scheduler *Scheduler) Stop() {
+	scheduler.lock.Lock()
+	quit, done := scheduler.quit, scheduler.done
+	scheduler.quit, scheduler.done = nil, nil
+	scheduler.lock.Unlock()
+
+	if quit == nil {
+		return
+	}
+
+	close(quit)
+	<-done
+}
+
+func (scheduler *Scheduler) run(quit, done chan struct{}) {
+	defer close(done)
+
+	for {
+		due, next, ok := scheduler.due()
+		for _, product := range due {
+			tick := LogEntry{Type: LogTick, LocationID: product.locationID, ProductID: product.ID}
+			product.log.Record(tick, product.DecrPrice)
+		}
+
+		var timer Timer
+		var fired <-chan time.Time
+		if ok {
+			timer = scheduler.clock.NewTimer(next.Sub(scheduler.clock.Now()))
+			fired = timer.C()
+		}
+
+		select {
+		case <-fired:
+		case <-scheduler.wake:
+		case <-quit:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// due takes the products whose tick has come and schedules their next one. It
+// also returns when the next tick after those is due, if any is.
+func (scheduler *Scheduler) due() ([]*Product, time.Time, bool) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	if !scheduler.paused.IsZero() || len(scheduler.queue) == 0 {
+		return nil, time.Time{}, false
+	}
+
+	now := scheduler.clock.Now()
+	var due []*Product
+	for len(scheduler.queue) > 0 && !scheduler.queue[0].due.After(now) {
+		tick := scheduler.queue[0]
+		due = append(due, tick.product)
+		tick.due = now.Add(tick.product.clockPeriod)
+		heap.Fix(&scheduler.queue, 0)
+	}
+
+	return due, scheduler.queue[0].due, true
+}
+
+// poke wakes the scheduler to look at its queue again. It must be called with
+// the scheduler lock held.
+func (scheduler *Scheduler) poke() {
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (queue tickQueue) Len() int {
+	return len(queue)
+}
+
+func (queue tickQueue) Less(i, j int) bool {
+	return queue[i].due.Before(queue[j].due)
+}
+
+func (queue tickQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].index = i
+	queue[j].index = j
+}
+
+func (queue *tickQueue) Push(x interface{}) {
+	tick := x.(*scheduledTick)
+	tick.index = len(*queue)
+	*queue = append(*queue, tick)
+}
+
+func (queue *tickQueue) Pop() interface{} {
+	old := *queue
+	tick := old[len(old)-1]
+	old[len(old)-1] = nil
+	*queue = old[:len(old)-1]
+	return tick
+}
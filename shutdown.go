@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serve runs server until the process is told to stop, then stops accepting
+// requests and gives those in flight up to timeout to finish.
+func serve(server *http.Server, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case received := <-signals:
+		log.Printf("%s received, shutting down", received)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("requests still in flight after %s: %s", timeout, err)
+	}
+
+	return nil
+}
+
+// CloseStreams ends every market's event streams, so streaming clients don't
+// hold up a shutdown.
+func (markets *Markets) CloseStreams() {
+	for _, market := range markets.All() {
+		market.Menu.Events.Close()
+	}
+}
+
+// Close stops every market's clock and flushes what is persisted: a final
+// snapshot to snapshotPath if there is one, the event log and price history.
+func (markets *Markets) Close(snapshotPath string) error {
+	markets.Stop()
+
+	var errs []error
+	if snapshotPath != "" {
+		errs = append(errs, WriteSnapshot(snapshotPath, markets.Snapshot()))
+	}
+	errs = append(errs, markets.Log.Close())
+	for _, market := range markets.All() {
+		errs = append(errs, market.Menu.History.Close())
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
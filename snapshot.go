@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxCatchUpTicks bounds how many missed clock ticks are applied to a
+// product when restoring an old snapshot.
+const maxCatchUpTicks = 10000
+
+// Snapshot is the state of every market at a point in time, enough to pick
+// up where the market left off after a restart.
+type Snapshot struct {
+	Time    time.Time        `json:"time"`
+	Markets []MarketSnapshot `json:"markets"`
+}
+
+type MarketSnapshot struct {
+	LocationID   int               `json:"locationId"`
+	Crashes      []Crash           `json:"crashes,omitempty"`
+	CrashHistory []Crash           `json:"crashHistory,omitempty"`
+	Clamps       []Clamp           `json:"clamps,omitempty"`
+	Products     []ProductSnapshot `json:"products"`
+	Retired      []ProductSnapshot `json:"retired,omitempty"`
+	Bills        []BillSnapshot    `json:"bills,omitempty"`
+}
+
+type ProductSnapshot struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	BasePrice int       `json:"basePrice"`
+	CostPrice int       `json:"costPrice,omitempty"`
+	ABV       float64   `json:"abv,omitempty"`
+	Volume    int       `json:"volumeMl,omitempty"`
+	Low       int       `json:"low"`
+	Current   int       `json:"current"`
+	High      int       `json:"high"`
+	Trend     string    `json:"trend"`
+	Sales     int       `json:"sales"`
+	SaleSteps []int     `json:"saleSteps,omitempty"`
+	Holding   int       `json:"holding,omitempty"`
+	Cooldown  time.Time `json:"cooldownEnds,omitempty"`
+	Frozen    bool      `json:"frozen,omitempty"`
+	Fixed     bool      `json:"fixed,omitempty"`
+	Edited    bool      `json:"edited,omitempty"`
+	Schedule  string    `json:"schedule,omitempty"`
+}
+
+func (product *Product) Snapshot() ProductSnapshot {
+	product.lock.RLock()
+	defer product.lock.RUnlock()
+
+	return ProductSnapshot{
+		ID:        product.ID,
+		Name:      product.Name,
+		BasePrice: product.BasePrice,
+		CostPrice: product.CostPrice,
+		ABV:       product.ABV,
+		Volume:    product.Volume,
+		Low:       product.lowPrice,
+		Current:   product.currentPrice,
+		High:      product.highPrice,
+		Trend:     product.Trend,
+		Sales:     product.sales,
+		SaleSteps: append([]int(nil), product.saleSteps...),
+		Holding:   product.holding,
+		Cooldown:  product.cooldownEnds,
+		Frozen:    product.frozen,
+		Fixed:     product.fixed,
+		Edited:    product.edited,
+		Schedule:  product.schedule,
+	}
+}
+
+// Restore puts the product back in the state of a snapshot, and records the
+// price it comes back at. Only a product bar staff renamed or repriced takes
+// its name and base price from the snapshot; otherwise the configuration's
+// win, and its prices move with a base price changed there.
+func (product *Product) Restore(snapshot ProductSnapshot) {
+	product.lock.Lock()
+	defer product.lock.Unlock()
+
+	configured := product.BasePrice
+	product.BasePrice = snapshot.BasePrice
+	product.lowPrice = snapshot.Low
+	product.currentPrice = snapshot.Current
+	product.highPrice = snapshot.High
+	product.Trend = snapshot.Trend
+	product.sales = snapshot.Sales
+	product.saleSteps = append([]int(nil), snapshot.SaleSteps...)
+	product.holding = snapshot.Holding
+	product.cooldownEnds = snapshot.Cooldown
+	product.frozen = snapshot.Frozen
+	product.fixed = snapshot.Fixed
+	product.schedule = snapshot.Schedule
+	product.usePriceSet()
+
+	price := configured
+	if snapshot.Edited {
+		product.Name = snapshot.Name
+		product.edited = true
+		price = snapshot.BasePrice
+	}
+	floor, err := product.checkBasePrice(price)
+	if err != nil && price != configured {
+		log.Printf("product %d: snapshot base price of %s refused: %s; using %s from the config",
+			product.ID, product.money.Format(price), err, product.money.Format(configured))
+		price = configured
+		product.edited = false
+		floor, err = product.checkBasePrice(price)
+	}
+	if err == nil && price != product.BasePrice {
+		log.Printf("product %d: base price is now %s, was %s in the snapshot",
+			product.ID, product.money.Format(price), product.money.Format(product.BasePrice))
+		product.rebase(price, floor)
+	}
+
+	product.history.Record(product.ID, product.Current(), CauseRestore)
+}
+
+// CatchUp applies the clock ticks a product missed while the market was
+// down, stopping early once the price has settled at its floor. A held
+// price stays where it was.
+func (product *Product) CatchUp(elapsed time.Duration) {
+	product.lock.RLock()
+	pinned := product.pinned()
+	product.lock.RUnlock()
+	if pinned {
+		return
+	}
+
+	ticks := int(elapsed / product.clockPeriod)
+	if ticks > maxCatchUpTicks {
+		ticks = maxCatchUpTicks
+	}
+
+	for i := 0; i < ticks; i++ {
+		product.DecrPrice()
+
+		product.lock.RLock()
+		settled := product.currentPrice == product.minPrice() && product.Trend == ""
+		product.lock.RUnlock()
+		if settled {
+			return
+		}
+	}
+}
+
+func (markets *Markets) Snapshot() Snapshot {
+	snapshot := Snapshot{Time: time.Now()}
+
+	for _, market := range markets.All() {
+		snapshot.Markets = append(snapshot.Markets, market.Snapshot())
+	}
+
+	return snapshot
+}
+
+func (market *Market) Snapshot() MarketSnapshot {
+	menu := market.Menu
+	snapshot := MarketSnapshot{
+		LocationID:   market.LocationID,
+		Crashes:      menu.Crash.Active(),
+		CrashHistory: menu.Crash.History(),
+		Clamps:       menu.Compliance.Clamps(),
+		Bills:        menu.Bills.Snapshot(),
+	}
+
+	for _, product := range menu.Products() {
+		snapshot.Products = append(snapshot.Products, product.Snapshot())
+	}
+	for _, product := range menu.RetiredProducts() {
+		snapshot.Retired = append(snapshot.Retired, product.Snapshot())
+	}
+
+	return snapshot
+}
+
+// Restore brings every market back to the state in snapshot, as of now.
+// Products added or retired at runtime are added or retired again, and every
+// product is moved on by the clock ticks it missed while the market was down.
+func (markets *Markets) Restore(snapshot Snapshot, now time.Time) {
+	elapsed := now.Sub(snapshot.Time)
+
+	for _, marketSnapshot := range snapshot.Markets {
+		market := markets.Location(marketSnapshot.LocationID)
+		if market == nil {
+			log.Printf("snapshot has location %d which is no longer configured", marketSnapshot.LocationID)
+			continue
+		}
+		market.restore(marketSnapshot, now, elapsed)
+	}
+}
+
+func (market *Market) restore(snapshot MarketSnapshot, now time.Time, elapsed time.Duration) {
+	menu := market.Menu
+
+	for _, productSnapshot := range snapshot.Products {
+		product := market.restoreProduct(productSnapshot)
+		if product != nil {
+			product.CatchUp(elapsed)
+		}
+	}
+
+	for _, productSnapshot := range snapshot.Retired {
+		if market.restoreProduct(productSnapshot) != nil {
+			menu.Retire(productSnapshot.ID)
+		}
+	}
+
+	// Crashes that haven't ended stay on the displays for the rest of their
+	// window.
+	var active []Crash
+	for _, crash := range snapshot.Crashes {
+		if now.Before(crash.Ends) {
+			active = append(active, crash)
+		}
+	}
+	menu.Crash.Restore(active, snapshot.CrashHistory)
+	menu.Compliance.Restore(snapshot.Clamps)
+	menu.Bills.Restore(snapshot.Bills, now)
+	for _, crash := range active {
+		menu.Crash.EndAfter(crash.ID, menu.Clock.After(crash.Ends.Sub(now)))
+	}
+}
+
+// LogStartup logs the state every market starts from, so a replay of the log
+// across a restart picks up from where the restarted market did.
+func (markets *Markets) LogStartup() {
+	for _, market := range markets.All() {
+		snapshot := market.Snapshot()
+		entry := LogEntry{Type: LogRestore, LocationID: market.LocationID, Snapshot: &snapshot}
+		markets.Log.Record(entry, func() {})
+	}
+}
+
+// Restart puts the market in the state a logged startup found it in, as of
+// now. Products it didn't have are dropped, those it had on sale are on sale
+// again, and demand starts counting afresh, as it does after a restart.
+func (market *Market) Restart(snapshot MarketSnapshot, now time.Time) []*Product {
+	menu := market.Menu
+
+	market.restore(snapshot, now, 0)
+	menu.arrange(snapshot)
+	menu.Demand.Reset()
+
+	return menu.Products()
+}
+
+// arrange leaves the menu with exactly the products in snapshot, on sale or
+// retired as they are there and in the same order.
+func (menu *Menu) arrange(snapshot MarketSnapshot) {
+	menu.lock.Lock()
+	defer menu.lock.Unlock()
+
+	products := map[int]*Product{}
+	for _, list := range [][]*Product{menu.Items, menu.Retired} {
+		for _, product := range list {
+			products[product.ID] = product
+		}
+	}
+
+	pick := func(snapshots []ProductSnapshot) []*Product {
+		var picked []*Product
+		for _, productSnapshot := range snapshots {
+			if product, ok := products[productSnapshot.ID]; ok {
+				picked = append(picked, product)
+				delete(products, productSnapshot.ID)
+			}
+		}
+		return picked
+	}
+	menu.Items = pick(snapshot.Products)
+	menu.Retired = pick(snapshot.Retired)
+
+	for _, product := range menu.Items {
+		product.scheduler.Add(product)
+	}
+	for _, product := range products {
+		product.Stop()
+	}
+}
+
+// restoreProduct finds a product on the menu, or adds it back if it was added
+// at runtime, and puts it in the snapshot's state.
+func (market *Market) restoreProduct(snapshot ProductSnapshot) *Product {
+	menu := market.Menu
+
+	product, err := menu.Lookup(snapshot.ID)
+	if err != nil {
+		product = market.Config.NewProduct(ProductConfig{
+			ID:        snapshot.ID,
+			Name:      snapshot.Name,
+			BasePrice: snapshot.BasePrice,
+			CostPrice: snapshot.CostPrice,
+			ABV:       snapshot.ABV,
+			Volume:    snapshot.Volume,
+		}, menu.ProductOptions()...)
+		err = menu.Add(product)
+		if err != nil {
+			product.Stop()
+			return nil
+		}
+	}
+
+	product.Restore(snapshot)
+	return product
+}
+
+// WriteSnapshot replaces the snapshot at path in one step, so a restart
+// mid-write finds either the old snapshot or the new one.
+func WriteSnapshot(path string, snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// ReadSnapshot reads the snapshot at path. It reports false if there isn't
+// one yet.
+func ReadSnapshot(path string) (Snapshot, bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+
+	return snapshot, true, nil
+}
+
+// snapshotEvery writes a snapshot of the markets to path every interval.
+func snapshotEvery(markets *Markets, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := WriteSnapshot(path, markets.Snapshot())
+		if err != nil {
+			log.Printf("writing snapshot: %s", err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import "math"
+
+// PriceState is the view of a product a PricingStrategy works from.
+type PriceState struct {
+	BasePrice int
+	Current   int
+	Min       int
+	Max       int
+	// Sales is the number of sales since the product last ticked or crashed.
+	Sales int
+}
+
+// PricingStrategy decides how a product's price moves. The product takes care
+// of clamping to its floor and of crashing when a sale pushes it past its
+// ceiling, so strategies only need to say where the price would go next.
+type PricingStrategy interface {
+	OnSale(state PriceState) int
+	OnTick(state PriceState) int
+	OnCrash(state PriceState) int
+}
+
+// StepStrategy moves the price by a fixed percentage in either direction and
+// crashes back to the floor. This is the original market behaviour.
+type StepStrategy struct {
+	Increment float64
+}
+
+func DefaultStrategy() PricingStrategy {
+	return StepStrategy{Increment: PriceIncrement}
+}
+
+func (s StepStrategy) OnSale(state PriceState) int {
+	return int(math.Ceil(float64(state.Current) * (1.0 + s.Increment)))
+}
+
+func (s StepStrategy) OnTick(state PriceState) int {
+	return int(math.Floor(float64(state.Current) * (1.0 - s.Increment)))
+}
+
+func (s StepStrategy) OnCrash(state PriceState) int {
+	return state.Min
+}
+
+// LinearStrategy moves the price by a fixed number of pence on every sale and
+// every tick.
+type LinearStrategy struct {
+	Step int
+}
+
+func (s LinearStrategy) OnSale(state PriceState) int {
+	return state.Current + s.Step
+}
+
+func (s LinearStrategy) OnTick(state PriceState) int {
+	return state.Current - s.Step
+}
+
+func (s LinearStrategy) OnCrash(state PriceState) int {
+	return state.Min
+}
+
+// ExponentialDecayStrategy rises like StepStrategy but on each tick sheds a
+// fixed fraction of whatever premium the price holds over its floor, so busy
+// drinks fall quickly and cheap ones settle gently.
+type ExponentialDecayStrategy struct {
+	Increment float64
+	Decay     float64
+}
+
+func (s ExponentialDecayStrategy) OnSale(state PriceState) int {
+	return int(math.Ceil(float64(state.Current) * (1.0 + s.Increment)))
+}
+
+func (s ExponentialDecayStrategy) OnTick(state PriceState) int {
+	premium := float64(state.Current - state.Min)
+	return state.Min + int(math.Floor(premium*(1.0-s.Decay)))
+}
+
+func (s ExponentialDecayStrategy) OnCrash(state PriceState) int {
+	return state.Min
+}
+
+// DemandElasticityStrategy makes each sale count for more the more the drink
+// has sold since the last tick, so a run on one product climbs faster than
+// steady trade.
+type DemandElasticityStrategy struct {
+	Increment  float64
+	Elasticity float64
+}
+
+func (s DemandElasticityStrategy) OnSale(state PriceState) int {
+	increment := s.Increment * (1.0 + s.Elasticity*float64(state.Sales))
+	return int(math.Ceil(float64(state.Current) * (1.0 + increment)))
+}
+
+func (s DemandElasticityStrategy) OnTick(state PriceState) int {
+	return int(math.Floor(float64(state.Current) * (1.0 - s.Increment)))
+}
+
+func (s DemandElasticityStrategy) OnCrash(state PriceState) int {
+	return state.Min
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const streamHeartbeat = 15 * time.Second
+
+// streamEvents serves market events as Server-Sent Events. A client that
+// reconnects with Last-Event-ID is sent whatever it missed first.
+func streamEvents(w http.ResponseWriter, r *http.Request, market *Market) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming unsupported"))
+		return
+	}
+
+	lastSeq, err := lastEventID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	subscription, missed := market.Menu.Events.Subscribe(lastSeq)
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range missed {
+		writeStreamEvent(w, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.C:
+			if !ok {
+				return
+			}
+			writeStreamEvent(w, event)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, event MarketEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+}
+
+type socketRequest struct {
+	Action   string `json:"action"`
+	Products []int  `json:"products"`
+}
+
+// socketFilter holds the products a websocket client has subscribed to. A
+// client that hasn't subscribed to anything gets every product.
+type socketFilter struct {
+	lock     sync.RWMutex
+	products map[int]bool
+}
+
+func (filter *socketFilter) Allows(productID int) bool {
+	filter.lock.RLock()
+	defer filter.lock.RUnlock()
+
+	return filter.products == nil || filter.products[productID]
+}
+
+func (filter *socketFilter) Apply(request socketRequest) error {
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+
+	switch request.Action {
+	case "subscribe":
+		if filter.products == nil {
+			filter.products = map[int]bool{}
+		}
+		for _, productID := range request.Products {
+			filter.products[productID] = true
+		}
+	case "unsubscribe":
+		if filter.products == nil {
+			filter.products = map[int]bool{}
+		}
+		for _, productID := range request.Products {
+			delete(filter.products, productID)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", request.Action)
+	}
+
+	return nil
+}
+
+// priceSocket serves market events over a websocket. Clients pick products
+// with ?products=1,2 or by sending subscribe and unsubscribe requests. A
+// client that stops reading is disconnected rather than allowed to hold up
+// the market, and can reconnect with ?lastEventId= to catch up.
+func priceSocket(w http.ResponseWriter, r *http.Request, market *Market) {
+	lastSeq, err := lastEventID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	filter := &socketFilter{}
+	if products := r.URL.Query().Get("products"); products != "" {
+		request := socketRequest{Action: "subscribe"}
+		for _, field := range strings.Split(products, ",") {
+			productID, err := strconv.Atoi(field)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			request.Products = append(request.Products, productID)
+		}
+		filter.Apply(request)
+	}
+
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+
+	subscription, missed := market.Menu.Events.Subscribe(lastSeq)
+	defer subscription.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			message, err := ws.ReadMessage(2 * streamHeartbeat)
+			if err != nil {
+				return
+			}
+
+			var request socketRequest
+			err = json.Unmarshal(message, &request)
+			if err == nil {
+				err = filter.Apply(request)
+			}
+			if err != nil {
+				data, _ := json.Marshal(map[string]string{"error": err.Error()})
+				ws.WriteFrame(websocketText, data, time.Now().Add(streamHeartbeat))
+			}
+		}
+	}()
+
+	send := func(event MarketEvent) error {
+		if !filter.Allows(event.ProductID) {
+			return nil
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return ws.WriteFrame(websocketText, data, time.Now().Add(streamHeartbeat))
+	}
+
+	for _, event := range missed {
+		if send(event) != nil {
+			ws.Close(websocketCloseNormal, "")
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.C:
+			if !ok && market.Menu.Events.Closed() {
+				ws.Close(websocketCloseGoingAway, "shutting down")
+				return
+			}
+			if !ok {
+				ws.Close(websocketCloseTryAgain, "too far behind")
+				return
+			}
+			err = send(event)
+		case <-heartbeat.C:
+			err = ws.WriteFrame(websocketPing, nil, time.Now().Add(streamHeartbeat))
+		case <-closed:
+			ws.Close(websocketCloseNormal, "")
+			return
+		}
+
+		if err != nil {
+			ws.Close(websocketCloseNormal, "")
+			return
+		}
+	}
+}
+
+func lastEventID(r *http.Request) (uint64, error) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	if lastEventID == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(lastEventID, 10, 64)
+}
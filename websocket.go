@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This is just enough of RFC 6455 to push JSON to displays and read their
+// subscription requests: no extensions, no subprotocols.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	websocketContinuation = 0x0
+	websocketText         = 0x1
+	websocketBinary       = 0x2
+	websocketClose        = 0x8
+	websocketPing         = 0x9
+	websocketPong         = 0xA
+)
+
+const websocketMaxMessage = 64 * 1024
+
+const (
+	websocketCloseNormal    = 1000
+	websocketCloseGoingAway = 1001
+	websocketCloseProtocol  = 1002
+	websocketCloseTooBig    = 1009
+	websocketCloseTryAgain  = 1013
+)
+
+var errWebsocketClosed = errors.New("websocket closed")
+
+type websocketConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock sync.Mutex
+}
+
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("websocket upgrade required"))
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing Sec-WebSocket-Key"))
+		return nil, errors.New("missing websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(buffered, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	err = buffered.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{conn: conn, reader: buffered.Reader}, nil
+}
+
+func headerContains(header http.Header, name, value string) bool {
+	for _, field := range header[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(field, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// close frames on the way. It fails if the client sends nothing, not even a
+// pong, for timeout.
+func (ws *websocketConn) ReadMessage(timeout time.Duration) ([]byte, error) {
+	var message []byte
+	for {
+		ws.conn.SetReadDeadline(time.Now().Add(timeout))
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case websocketPing:
+			err = ws.WriteFrame(websocketPong, payload, time.Now().Add(streamHeartbeat))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case websocketPong:
+			continue
+		case websocketClose:
+			ws.Close(websocketCloseNormal, "")
+			return nil, errWebsocketClosed
+		case websocketText, websocketBinary, websocketContinuation:
+		default:
+			ws.Close(websocketCloseProtocol, "unknown opcode")
+			return nil, errWebsocketClosed
+		}
+
+		message = append(message, payload...)
+		if len(message) > websocketMaxMessage {
+			ws.Close(websocketCloseTooBig, "message too big")
+			return nil, errWebsocketClosed
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (ws *websocketConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(ws.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(ws.reader, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(ws.reader, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	// Clients must mask every frame they send.
+	if !masked {
+		ws.Close(websocketCloseProtocol, "frames must be masked")
+		return false, 0, nil, errWebsocketClosed
+	}
+	if length > websocketMaxMessage {
+		ws.Close(websocketCloseTooBig, "message too big")
+		return false, 0, nil, errWebsocketClosed
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(ws.reader, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(ws.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteFrame sends a single unfragmented frame, giving up at deadline so a
+// client that has stopped reading can't hold up the writer.
+func (ws *websocketConn) WriteFrame(opcode byte, payload []byte, deadline time.Time) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	frame = append(frame, payload...)
+
+	ws.conn.SetWriteDeadline(deadline)
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame with the given status and shuts the connection.
+func (ws *websocketConn) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	ws.WriteFrame(websocketClose, payload, time.Now().Add(time.Second))
+	return ws.conn.Close()
+}